@@ -1,13 +1,26 @@
 package collect
 
 import (
+	"FreeProxyMange/pool"
 	"context"
 	"sync"
 )
 
 func Run(ctx context.Context, wg *sync.WaitGroup) {
+	pool.AddDemandHook(Wake)
 	go func(ctx context.Context, wg *sync.WaitGroup) {
 		defer wg.Done()
 		ZdopenTask(ctx)
 	}(ctx, wg)
 }
+
+// 池子里没有可分配的ip时马上采集，不用等下一轮
+var wake = make(chan struct{}, 1)
+
+// Wake 唤醒采集任务，已经在等着被唤醒的不重复发
+func Wake() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
@@ -22,15 +22,23 @@ func ZdopenTask(ctx context.Context) {
 			default:
 				// 模拟正常业务运行
 				gt.Info("启动采集任务....")
-				time.Sleep(14 * time.Second)
+				select {
+				case <-ctx.Done():
+					continue
+				case <-wake:
+					gt.Info("按需采集")
+				case <-time.After(14 * time.Second):
+				}
 				ctx, err := gt.Get("http://www.zdopen.com/ShortProxy/GetIP/?api=202601112328085632&akey=3b61ce2c13043ee9&count=1&timespan=3&type=1")
 				if err != nil {
 					gt.Error("提取ip失败:", err)
 				} else {
 					ip := ctx.RespBodyString()
 					gt.Info("提取到的ip = ", ip)
-					proxyIP := &pool.ProxyIP{
-						IP: ip,
+					proxyIP, err := pool.ParseProxy(ip)
+					if err != nil {
+						gt.Error("解析ip失败，err = ", err)
+						continue
 					}
 					err = proxyIP.Add()
 					if err != nil {
@@ -0,0 +1,93 @@
+package conf
+
+import (
+	"strings"
+	"time"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+配置文件 ./conf.yaml
+不存在或某一项没有配置时都使用默认值
+
+*/
+
+const Path = "./conf.yaml"
+
+func Init() {
+	if err := gt.NewConf(Path); err != nil {
+		gt.Info("未加载配置文件，使用默认配置: ", err)
+	}
+}
+
+func Get(key string) interface{} {
+	if gt.Config == nil || gt.Config.Data == nil {
+		return nil
+	}
+	return gt.Config.Data[key]
+}
+
+func Str(key string, def string) string {
+	v := Get(key)
+	if v == nil {
+		return def
+	}
+	return gt.Any2String(v)
+}
+
+func Int(key string, def int) int {
+	v := Get(key)
+	if v == nil {
+		return def
+	}
+	return gt.Any2Int(v)
+}
+
+func Bool(key string, def bool) bool {
+	switch v := Get(key).(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return def
+}
+
+// Duration 配置值为 "30s" "5m" 这种格式，纯数字按秒处理
+func Duration(key string, def time.Duration) time.Duration {
+	v := Get(key)
+	if v == nil {
+		return def
+	}
+	d, err := time.ParseDuration(gt.Any2String(v))
+	if err != nil {
+		return time.Duration(gt.Any2Int(v)) * time.Second
+	}
+	return d
+}
+
+// List 配置值可以是 yaml 数组，也可以是逗号分隔的字符串
+func List(key string, def []string) []string {
+	switch v := Get(key).(type) {
+	case nil:
+		return def
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s := strings.TrimSpace(gt.Any2String(item)); s != "" {
+				list = append(list, s)
+			}
+		}
+		return list
+	default:
+		list := make([]string, 0)
+		for _, item := range strings.Split(gt.Any2String(v), ",") {
+			if s := strings.TrimSpace(item); s != "" {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+}
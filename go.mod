@@ -7,6 +7,7 @@ toolchain go1.24.11
 require (
 	github.com/dgraph-io/badger/v4 v4.9.0
 	github.com/mangenotwork/gathertool v0.4.7
+	github.com/oschwald/geoip2-golang v1.11.0
 )
 
 require (
@@ -39,6 +40,7 @@ require (
 	github.com/klauspost/compress v1.18.0 // indirect
 	github.com/mohae/deepcopy v0.0.0-20170929034955-c48cc78d4826 // indirect
 	github.com/nsqio/go-nsq v1.1.0 // indirect
+	github.com/oschwald/maxminddb-golang v1.13.0 // indirect
 	github.com/pierrec/lz4/v4 v4.1.17 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475 // indirect
@@ -2,6 +2,7 @@ package main
 
 import (
 	"FreeProxyMange/collect"
+	"FreeProxyMange/conf"
 	"FreeProxyMange/pool"
 	"FreeProxyMange/serve"
 	"FreeProxyMange/target"
@@ -17,6 +18,7 @@ import (
 func main() {
 
 	gt.Info("free proxy mange")
+	conf.Init()
 	var wg sync.WaitGroup
 	ctx, cancel := context.WithCancel(context.Background())
 	wg.Add(1)
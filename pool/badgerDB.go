@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sync"
 
 	"github.com/dgraph-io/badger/v4"
 	"github.com/dgraph-io/badger/v4/options"
@@ -19,6 +20,81 @@ func (l *nullLogger) Warningf(format string, v ...interface{}) {}
 func (l *nullLogger) Infof(format string, v ...interface{})    {}
 func (l *nullLogger) Debugf(format string, v ...interface{})   {}
 
+// ======================================
+// 数据库连接缓存
+// BadgerDB 同一个目录只能被打开一次，并发检查时每次读写都重新打开会拿不到目录锁，
+// 所以每张表只打开一次，程序退出时统一关闭
+// ======================================
+var (
+	dbMap    = make(map[string]*badger.DB)
+	dbLock   sync.Mutex
+	dbClosed bool
+)
+
+func openDB(dbPath string) (*badger.DB, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	if dbClosed {
+		return nil, errors.New("数据库已关闭")
+	}
+	if db, ok := dbMap[dbPath]; ok {
+		return db, nil
+	}
+
+	// 统一配置 BadgerDB（保留原有高性能配置）
+	opts := badger.DefaultOptions(dbPath).
+		WithMemTableSize(16 << 20).
+		WithValueLogFileSize(64 << 20).
+		WithSyncWrites(false).
+		WithCompression(options.ZSTD).WithLogger(&nullLogger{})
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, fmt.Errorf("打开数据库失败: %w", err)
+	}
+	dbMap[dbPath] = db
+	return db, nil
+}
+
+// CloseDB 关闭所有打开的表
+func CloseDB() {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	dbClosed = true
+	for p, db := range dbMap {
+		if err := db.Close(); err != nil {
+			gt.Error("关闭数据库失败: ", p, err)
+		}
+	}
+	dbMap = make(map[string]*badger.DB)
+}
+
+// ReopenDB 关闭之后重新允许打开，用到时按路径重新打开，测试里模拟重启用
+func ReopenDB() {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	dbClosed = false
+}
+
+// 存库时要带上代理密码，ProxyIP 的 JSON 里不带密码，接口返回时不会泄露
+type storedProxyIP struct {
+	*ProxyIP
+	Pass string `json:"pass"`
+}
+
+func encodeProxyIP(p *ProxyIP) ([]byte, error) {
+	return json.Marshal(storedProxyIP{ProxyIP: p, Pass: p.Pass})
+}
+
+func decodeProxyIP(b []byte) (*ProxyIP, error) {
+	s := storedProxyIP{ProxyIP: &ProxyIP{}}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	s.ProxyIP.Pass = s.Pass
+	return s.ProxyIP, nil
+}
+
 // ======================================
 // BadgerUpsertStruct：插入或更新数据（不存在则新增，存在则修改）
 // dbPath: 数据库路径（入参）
@@ -39,24 +115,16 @@ func BadgerUpsertStruct(dbPath string, key string, value *ProxyIP) error {
 	}
 
 	// 结构体序列化为 JSON 字节数组（仅一次序列化，减少冗余）
-	valueBytes, err := json.Marshal(value)
+	valueBytes, err := encodeProxyIP(value)
 	if err != nil {
 		return fmt.Errorf("结构体序列化失败: %w", err)
 	}
 
-	// 统一配置 BadgerDB（保留原有高性能配置）
-	opts := badger.DefaultOptions(dbPath).
-		WithMemTableSize(16 << 20).
-		WithValueLogFileSize(64 << 20).
-		WithSyncWrites(false).
-		WithCompression(options.ZSTD).WithLogger(&nullLogger{})
-
 	// 打开数据库
-	db, err := badger.Open(opts)
+	db, err := openDB(dbPath)
 	if err != nil {
-		return fmt.Errorf("打开数据库失败: %w", err)
+		return err
 	}
-	defer db.Close()
 
 	// 核心逻辑：无需检查键是否存在，直接 Set（BadgerDB 的 Set 操作天然支持覆盖）
 	var isCreate bool // 标记是新增还是更新
@@ -80,11 +148,15 @@ func BadgerUpsertStruct(dbPath string, key string, value *ProxyIP) error {
 		return fmt.Errorf("Upsert 数据失败: %w", err)
 	}
 
-	// 区分日志输出（保持原有日志格式）
+	// 区分日志输出（保持原有日志格式），密码不打到日志里
+	logged := *value
+	if logged.Pass != "" {
+		logged.Pass = "***"
+	}
 	if isCreate {
-		log.Printf("[新增成功] 路径：%s | 键：%s | 值：%+v", dbPath, key, value)
+		log.Printf("[新增成功] 路径：%s | 键：%s | 值：%+v", dbPath, key, &logged)
 	} else {
-		log.Printf("[更新成功] 路径：%s | 键：%s | 新值：%+v", dbPath, key, value)
+		log.Printf("[更新成功] 路径：%s | 键：%s | 新值：%+v", dbPath, key, &logged)
 	}
 	return nil
 }
@@ -103,13 +175,11 @@ func BadgerReadStruct(dbPath string, key string) (*ProxyIP, bool, error) {
 		return nil, false, errors.New("键不能为空")
 	}
 
-	// 打开数据库（只读模式）
-	opts := badger.DefaultOptions(dbPath).WithLogger(&nullLogger{})
-	db, err := badger.Open(opts)
+	// 打开数据库
+	db, err := openDB(dbPath)
 	if err != nil {
-		return nil, false, fmt.Errorf("打开数据库失败: %w", err)
+		return nil, false, err
 	}
-	defer db.Close()
 
 	var valueBytes []byte
 	// 读事务查询数据
@@ -140,13 +210,12 @@ func BadgerReadStruct(dbPath string, key string) (*ProxyIP, bool, error) {
 	}
 
 	// 反序列化为结构体
-	var result ProxyIP
-	err = json.Unmarshal(valueBytes, &result)
+	result, err := decodeProxyIP(valueBytes)
 	if err != nil {
 		return nil, false, fmt.Errorf("结构体反序列化失败: %w", err)
 	}
 
-	return &result, true, nil
+	return result, true, nil
 }
 
 // ======================================
@@ -161,12 +230,10 @@ func BadgerDeleteStruct(dbPath string, key string) error {
 		return errors.New("键不能为空")
 	}
 
-	opts := badger.DefaultOptions(dbPath).WithLogger(&nullLogger{})
-	db, err := badger.Open(opts)
+	db, err := openDB(dbPath)
 	if err != nil {
-		return fmt.Errorf("打开数据库失败: %w", err)
+		return err
 	}
-	defer db.Close()
 
 	err = db.Update(func(txn *badger.Txn) error {
 		// 检查键是否存在
@@ -204,17 +271,11 @@ func BadgerGetAllKeys(dbPath string) ([]string, error) {
 		return nil, errors.New("数据库路径不能为空")
 	}
 
-	// 配置：只读模式 + 禁用不必要的缓存（极致轻量）
-	opts := badger.DefaultOptions(dbPath).
-		WithSyncWrites(false).                                  // 关闭同步写（只读场景无意义）
-		WithCompression(options.None).WithLogger(&nullLogger{}) // 遍历 Key 无需解压 Value，关闭压缩加速
-
 	// 打开数据库
-	db, err := badger.Open(opts)
+	db, err := openDB(dbPath)
 	if err != nil {
-		return nil, fmt.Errorf("打开数据库失败: %w", err)
+		return nil, err
 	}
-	defer db.Close()
 
 	// 预分配切片（减少内存分配次数，提升速度）
 	keys := make([]string, 0, 1024) // 初始容量 1024，可根据实际数据量调整
@@ -239,6 +300,48 @@ func BadgerGetAllKeys(dbPath string) ([]string, error) {
 		return nil, fmt.Errorf("查询所有 Key 失败: %w", err)
 	}
 
-	gt.Info("[查询所有 Key 成功] 路径：%s | 共查询到 %d 个 Key", dbPath, len(keys))
+	gt.Infof("[查询所有 Key 成功] 路径：%s | 共查询到 %d 个 Key", dbPath, len(keys))
 	return keys, nil
 }
+
+// ======================================
+// 查询表里所有数据
+// dbPath: 数据库路径（入参）
+// 返回：所有结构体值、错误信息
+// 反序列化失败的值跳过
+// ======================================
+func BadgerGetAllStruct(dbPath string) ([]*ProxyIP, error) {
+	if dbPath == "" {
+		return nil, errors.New("数据库路径不能为空")
+	}
+
+	db, err := openDB(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*ProxyIP, 0, 1024)
+	err = db.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			valueBytes, err := iter.Item().ValueCopy(nil)
+			if err != nil {
+				return fmt.Errorf("拷贝值失败: %w", err)
+			}
+			value, err := decodeProxyIP(valueBytes)
+			if err != nil {
+				gt.Error("结构体反序列化失败: ", string(iter.Item().Key()), err)
+				continue
+			}
+			list = append(list, value)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("查询所有数据失败: %w", err)
+	}
+	return list, nil
+}
@@ -0,0 +1,101 @@
+package pool
+
+import (
+	"FreeProxyMange/conf"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"time"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+带宽测试:
+通过代理下载指定大小的数据，记录首字节时间和持续下载速度，默认不开启
+1. bandwidthUrl       下载地址，{size} 会替换成 bandwidthSize，
+                      可以用自己部署的判官端口(judgeAddr)上的 /bytes?size={size}，也可以用 https://speed.cloudflare.com/__down?bytes={size}
+2. bandwidthSize      下载多少字节，默认 1MB
+3. bandwidthInterval  同一个ip多久测一次，默认 30m，带宽测试比较耗流量
+
+*/
+
+// BandwidthDue 是否到了该测带宽的时间
+func (p *ProxyIP) BandwidthDue() bool {
+	if conf.Str("bandwidthUrl", "") == "" {
+		return false
+	}
+	interval := conf.Duration("bandwidthInterval", 30*time.Minute)
+	return time.Since(time.Unix(p.BandwidthTime, 0)) >= interval
+}
+
+// measureBandwidth 测带宽并记到记录和这次的检查记录上
+func (p *ProxyIP) measureBandwidth(ctx context.Context, log *CheckLog) {
+	kbps, ttfb, err := p.CheckBandwidth(ctx)
+	if err != nil {
+		// 测不出来就不能再按旧的带宽分配，min_kbps 筛选时当作没有测过
+		gt.Error("带宽测试失败: ", err)
+		p.Kbps = 0
+		p.TTFBMs = 0
+	} else {
+		p.Kbps = kbps
+		p.TTFBMs = ttfb.Milliseconds()
+		log.Kbps = kbps
+		log.TTFBMs = p.TTFBMs
+	}
+	p.BandwidthTime = time.Now().Unix()
+}
+
+// CheckBandwidth 通过代理下载数据，返回持续下载速度 kbps 和首字节时间
+func (p *ProxyIP) CheckBandwidth(ctx context.Context) (int64, time.Duration, error) {
+	size := conf.Int("bandwidthSize", 1<<20)
+	caseUrl := strings.ReplaceAll(conf.Str("bandwidthUrl", ""), "{size}", strconv.Itoa(size))
+	if caseUrl == "" {
+		return 0, 0, fmt.Errorf("没有配置 bandwidthUrl")
+	}
+
+	var firstByte time.Time
+	trace := &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			firstByte = time.Now()
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, caseUrl, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("User-Agent", gt.GetAgent(gt.PCAgent))
+
+	start := time.Now()
+	resp, err := p.Client(60 * time.Second).Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("带宽测试返回状态码 %d", resp.StatusCode)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	end := time.Now()
+	if err != nil {
+		return 0, 0, err
+	}
+	if firstByte.IsZero() {
+		firstByte = start
+	}
+	ttfb := firstByte.Sub(start)
+
+	// 持续速度只算首字节之后的下载时间，不含建连和握手
+	elapsed := end.Sub(firstByte)
+	if elapsed < time.Millisecond {
+		elapsed = time.Millisecond
+	}
+	kbps := n * 8 * int64(time.Second) / int64(elapsed) / 1000
+	gt.Info(p.IP, " 带宽测试 下载:", n, "字节 kbps:", kbps, " 首字节:", ttfb)
+	return kbps, ttfb, nil
+}
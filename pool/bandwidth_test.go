@@ -0,0 +1,83 @@
+package pool
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 每 50ms 返回 64KB，下载 256KB 大约 10Mbps
+func newSlowBytes(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bytes" {
+			http.NotFound(w, r)
+			return
+		}
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		chunk := make([]byte, 64<<10)
+		for size > 0 {
+			n := len(chunk)
+			if size < n {
+				n = size
+			}
+			if _, err := w.Write(chunk[:n]); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			size -= n
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestMeasureBandwidth(t *testing.T) {
+	srv := newSlowBytes(t)
+	useTestDir(t, "bandwidthUrl: "+srv.URL+"/bytes?size={size}\nbandwidthSize: 262144\n")
+	p := &ProxyIP{IP: newTestProxy(t, nil), Type: ProtocolHttp}
+	if !p.BandwidthDue() {
+		t.Fatal("没测过应该到了测带宽的时间")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var log CheckLog
+	p.measureBandwidth(ctx, &log)
+	// 256KB 首字节之后大约 150ms 下完，机器慢时放宽
+	if p.Kbps < 2000 || p.Kbps > 20000 || log.Kbps != p.Kbps {
+		t.Fatalf("kbps = %d 检查记录 = %d", p.Kbps, log.Kbps)
+	}
+	if p.TTFBMs > 100 || log.TTFBMs != p.TTFBMs {
+		t.Fatalf("首字节时间 = %dms", p.TTFBMs)
+	}
+	if p.BandwidthDue() {
+		t.Fatal("刚测过不应该再测")
+	}
+}
+
+// 测不出来时清掉旧的带宽，min_kbps 不能再按旧值分配
+func TestMeasureBandwidthFailed(t *testing.T) {
+	srv := newSlowBytes(t)
+	useTestDir(t, "bandwidthUrl: "+srv.URL+"/missing?size={size}\n")
+	p := &ProxyIP{IP: newTestProxy(t, nil), Type: ProtocolHttp, Kbps: 8000, TTFBMs: 30}
+	var log CheckLog
+	p.measureBandwidth(context.Background(), &log)
+	if p.Kbps != 0 || p.TTFBMs != 0 || log.Kbps != 0 {
+		t.Fatalf("失败后 kbps = %d ttfb = %d", p.Kbps, p.TTFBMs)
+	}
+	if p.BandwidthTime == 0 {
+		t.Fatal("失败也要记录测试时间")
+	}
+}
+
+func TestBandwidthDisabled(t *testing.T) {
+	useTestDir(t, "")
+	if (&ProxyIP{}).BandwidthDue() {
+		t.Fatal("没配置 bandwidthUrl 不测带宽")
+	}
+}
@@ -1,12 +1,14 @@
 package pool
 
 import (
+	"FreeProxyMange/conf"
 	"context"
 	"fmt"
 	"hash/fnv"
 	"os"
 	"sort"
 	"sync"
+	"time"
 
 	gt "github.com/mangenotwork/gathertool"
 )
@@ -24,39 +26,132 @@ var tableCount = 32
 */
 
 func Run(ctx context.Context, wg *sync.WaitGroup) {
+	Checker = NewScheduler()
 	go func(ctx context.Context, wg *sync.WaitGroup) {
 		defer wg.Done()
 
 		CheckTask(ctx)
+		// 阻塞到所有检查 worker 退出，再关闭数据库
+		Checker.Run(ctx)
+		CloseDB()
 
 	}(ctx, wg)
 }
 
 type ProxyIP struct {
-	IP            string `json:"ip"`
-	Type          string `json:"type"` // http https socket5
-	Site          string `json:"site"`
-	LastCheckTime string `json:"lastCheckTime"` // 最后检查时间
-	CheckNum      int    `json:"checkNum"`      // 检查次数
-	LastCheckMs   string `json:"lastCheckMs"`   // 最后检查IP响应时间ms
-	FailNum       int    `json:"failNum"`
+	IP            string   `json:"ip"`
+	Type          string   `json:"type"`          // 代理类型 http socks4 socks5
+	Protocols     []string `json:"protocols"`     // 探测出支持的全部协议 http https socks4 socks4a socks5
+	User          string   `json:"user"`          // 代理认证账号，socks4 作为 userid
+	Pass          string   `json:"-"`             // 不在接口里返回，只出现在代理地址里，存库见 storedProxyIP
+	Site          string   `json:"site"`          // 当前验证通过的网站名，逗号分隔
+	LastCheckTime string   `json:"lastCheckTime"` // 最后检查时间
+	CheckNum      int      `json:"checkNum"`      // 检查次数
+	LastCheckMs   string   `json:"lastCheckMs"`   // 最后检查IP响应时间ms
+	FailNum       int      `json:"failNum"`
+	Anonymity     string   `json:"anonymity"` // 匿名度 transparent anonymous elite
+
+	AddTime            int64 `json:"addTime"`            // 入池时间
+	ConsecutiveSuccess int   `json:"consecutiveSuccess"` // 连续检查成功次数
+	ConsecutiveFail    int   `json:"consecutiveFail"`    // 连续检查失败次数
+	NextCheckTime      int64 `json:"nextCheckTime"`      // 下一次检查时间
+
+	Sites map[string]*SiteResult `json:"sites"` // 每个网站的验证结果
+
+	ExitIP  string   `json:"exitIP"`  // 判官看到的出口IP
+	Geo     *GeoInfo `json:"geo"`     // 入口IP的地理信息
+	ExitGeo *GeoInfo `json:"exitGeo"` // 出口IP的地理信息
+
+	Ms      int64      `json:"ms"`      // 最后一次检查成功的响应时间ms
+	Score   float64    `json:"score"`   // 质量分，见 score.go
+	History []CheckLog `json:"history"` // 最近的检查记录，最多保留 historySize 条
+
+	Kbps          int64 `json:"kbps"`          // 最后一次带宽测试的持续下载速度
+	TTFBMs        int64 `json:"ttfbMs"`        // 最后一次带宽测试的首字节时间ms
+	BandwidthTime int64 `json:"bandwidthTime"` // 最后一次带宽测试时间
+
+	Intercepted  bool   `json:"intercepted"`  // 拦截了 TLS，见 security.go
+	Tampered     bool   `json:"tampered"`     // 篡改了响应内容
+	SecurityNote string `json:"securityNote"` // 安全检查的说明
+	SecurityTime int64  `json:"securityTime"` // 最后一次安全检查时间
+
+	ExitIPs     []ExitRecord `json:"exitIPs"`     // 最近观察到的不同出口IP，见 exit.go
+	Backconnect bool         `json:"backconnect"` // 出口和入口不是同一个IP
+	Rotating    bool         `json:"rotating"`    // 出口IP经常变化
+
+	FailClassNum         map[string]int `json:"failClassNum"`         // 每一类失败的总次数，见 failure.go
+	LastFailClass        string         `json:"lastFailClass"`        // 最近一次失败的分类，检查成功后清空
+	ConsecutiveClassFail int            `json:"consecutiveClassFail"` // 最近一次失败的分类连续失败次数
+
+	State        string        `json:"state"`        // 生命周期状态，见 state.go
+	StateTime    int64         `json:"stateTime"`    // 进入当前状态的时间
+	StateHistory []StateChange `json:"stateHistory"` // 最近的状态变化
+	DeadTime     int64         `json:"deadTime"`     // 进入墓地的时间，复活检查失败不更新，复活后清零
+
+	DomainBans map[string]int64 `json:"domainBans"` // 使用方反馈被封的域名 -> 禁用到什么时候，见 feedback.go
 }
 
+// CheckLog 一次检查的记录
+type CheckLog struct {
+	Time   int64  `json:"time"`
+	OK     bool   `json:"ok"`
+	Ms     int64  `json:"ms"`
+	Kbps   int64  `json:"kbps,omitempty"`   // 这次检查做了带宽测试才有
+	TTFBMs int64  `json:"ttfbMs,omitempty"` // 这次检查做了带宽测试才有
+	Fail   string `json:"fail,omitempty"`   // 失败的分类，见 failure.go
+	Source string `json:"source,omitempty"` // 记录来源，检查为空，使用方反馈为 feedback
+	Domain string `json:"domain,omitempty"` // 使用方反馈的目标域名
+}
+
+// AddHistory 追加一条检查记录，超过 historySize 丢掉最早的
+func (p *ProxyIP) AddHistory(log CheckLog) {
+	p.History = append(p.History, log)
+	if size := conf.Int("historySize", 50); size > 0 && len(p.History) > size {
+		p.History = p.History[len(p.History)-size:]
+	}
+}
+
+// Add 添加ip到池子，已在池子里的保留原有记录，不会重置检查历史
+// 墓地里的ip被重新采集到时马上做一次复活检查
 func (p *ProxyIP) Add() error {
-	hash := fnv.New64a()
-	_, err := hash.Write([]byte(p.IP))
+	old, ok, err := Get(p.IP)
 	if err != nil {
 		return err
 	}
-	hashValue := hash.Sum64()
-	table := fmt.Sprintf("./data/%d", (hashValue % uint64(tableCount)))
-	err = BadgerUpsertStruct(table, p.IP, p)
+	if ok {
+		if old.State == StateDead {
+			plan.Set(old.IP, time.Now().Unix())
+		}
+		return nil
+	}
+	now := time.Now().Unix()
+	p.AddTime = now
+	p.NextCheckTime = now
+	p.State = StateNew
+	p.StateTime = now
+	stateIndex.Set(p.IP, StateNew)
+	p.EnrichGeo()
+	err = BadgerUpsertStruct(DBPath(p.IP), p.IP, p)
 	if err != nil {
 		return err
 	}
+	plan.Set(p.IP, p.NextCheckTime)
 	return err
 }
 
+// DBPath ip 按hash分表存储，返回所在的表
+func DBPath(ip string) string {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(ip))
+	hashValue := hash.Sum64()
+	return fmt.Sprintf("./data/%d", (hashValue % uint64(tableCount)))
+}
+
+// Get 从池子里读取ip的记录
+func Get(ip string) (*ProxyIP, bool, error) {
+	return BadgerReadStruct(DBPath(ip), ip)
+}
+
 func AllDBPath() []string {
 	fList, err := GetSubdirectories("./data")
 	if err != nil {
@@ -104,5 +199,10 @@ func GetAllKey(page int) ([]string, error) {
 	}
 	path := dbList[page]
 	gt.Info("path = ", path)
-	return BadgerGetAllKeys(path)
+	keys, err := BadgerGetAllKeys(path)
+	if err != nil {
+		return nil, err
+	}
+	SortByScore(keys)
+	return keys, nil
 }
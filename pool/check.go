@@ -2,57 +2,40 @@ package pool
 
 import (
 	"context"
-	"strings"
+	"errors"
+	"net/http"
+	"sync"
 	"time"
 
 	gt "github.com/mangenotwork/gathertool"
 )
 
+var (
+	ErrDead       = errors.New("连续检查失败，已标记为死亡放入墓地")
+	ErrNoProtocol = errors.New("没有探测到支持的协议")
+)
+
+// CheckTask 恢复检查计划后每秒把到了检查时间的ip提交给检查调度器
 func CheckTask(ctx context.Context) {
 
 	go func(ctx context.Context) {
+		loadPlan()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
 		for {
 
 			select {
 			case <-ctx.Done():
 				gt.Info("启动池子维护任务 收到退出信号，开始停止服务...")
-				// 这里可以写收尾逻辑：关闭数据库连接、清理临时文件、保存状态等
-				time.Sleep(1 * time.Second) // 模拟收尾耗时
 				gt.Info("池子检查已安全停止")
 				return
 
-			default:
-				gt.Info("启动池子维护任务....")
-
-				time.Sleep(4 * time.Second)
-				for _, p := range AllDBPath() {
-					ips, err := BadgerGetAllKeys(p)
-					if err != nil {
-						gt.Error(err)
-					}
-					gt.Info("ips = ", ips)
-					for _, v := range ips {
-						gt.Info("准备检查 ", v)
-						time.Sleep(1 * time.Second)
-						ip, ok, err := BadgerReadStruct(p, v)
-						if err != nil {
-							gt.Error(err)
-						}
-						if ok {
-							if ip.FailNum > 4 {
-								gt.Info(ip.IP, "验证4次都失败了,执行删除")
-								BadgerDeleteStruct(p, ip.IP)
-							}
-							cms, err := CheckMs(ip.IP)
-							if err != nil {
-								ip.FailNum++
-							} else {
-								ip.CheckNum++
-								ip.LastCheckTime = time.Now().GoString()
-								ip.LastCheckMs = cms
-							}
-							BadgerUpsertStruct(p, ip.IP, ip)
-						}
+			case <-ticker.C:
+				now := time.Now().Unix()
+				for _, v := range plan.Due(now) {
+					if !Checker.Submit(v) {
+						// 已在队列里的检查完会重新计划，队列满的稍后再提交
+						plan.Set(v, now+checkRetryDelay)
 					}
 				}
 			}
@@ -62,38 +45,271 @@ func CheckTask(ctx context.Context) {
 
 }
 
-func Check(ip string) string {
+// CheckHook 每次检查完成后调用，err 为 nil 表示检查通过
+// 回调在ip锁内执行，拿到的就是刚写进池子的记录，期间状态不会被别的地方改，回调里不能再调用 SetState
+type CheckHook func(ip *ProxyIP, err error)
+
+var (
+	checkHooks     []CheckHook
+	checkHooksLock sync.RWMutex
+)
+
+// AddCheckHook 注册检查完成的回调，target 用它维护可分配的ip
+func AddCheckHook(hook CheckHook) {
+	checkHooksLock.Lock()
+	defer checkHooksLock.Unlock()
+	checkHooks = append(checkHooks, hook)
+}
 
-	if !strings.HasPrefix(ip, "http://") && !strings.HasPrefix(ip, "https://") {
-		ip = "http://" + ip
+func runCheckHooks(ip *ProxyIP, err error) {
+	checkHooksLock.RLock()
+	defer checkHooksLock.RUnlock()
+	for _, hook := range checkHooks {
+		hook(ip, err)
 	}
+}
 
-	// https://myip.ipip.net
+// checkOne 检查一个ip并更新池子里的记录，由调度器的 worker 调用
+func checkOne(ctx context.Context, v string) error {
+	p := DBPath(v)
+	ip, ok, err := BadgerReadStruct(p, v)
+	if err != nil {
+		// 计划已经被取走了，读失败也要重新计划，不然再也不会检查
+		gt.Error(err)
+		plan.Set(v, time.Now().Unix()+checkRetryDelay)
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	// 墓地里的ip做复活检查，超过保留时间的彻底删除
+	resurrect := ip.State == StateDead
+	if resurrect && ip.graveyardExpired() {
+		unlock := lockIP(v)
+		defer unlock()
+		return purgeIP(p, ip)
+	}
+	// 可用和已分配的ip复查时状态不变，其他的进入检查中
+	switch ip.State {
+	case "", StateNew, StateCooling, StateQuarantined, StateDead:
+		reason := "开始检查"
+		if resurrect {
+			reason = "复活检查"
+		}
+		if ip, err = SetState(v, StateValidating, reason); err != nil {
+			gt.Error(err)
+			plan.Set(v, time.Now().Unix()+checkRetryDelay)
+			return err
+		}
+	}
+
+	checkLog := CheckLog{Time: time.Now().Unix()}
+	if len(ip.Protocols) == 0 && len(ip.DetectProtocols(ctx)) == 0 {
+		gt.Info(ip.IP, "没有探测到支持的协议")
+		err = ErrNoProtocol
+	} else {
+		var ms time.Duration
+		ms, err = ip.CheckMs(ctx)
+		if err == nil {
+			ip.CheckNum++
+			ip.LastCheckTime = time.Now().GoString()
+			ip.LastCheckMs = ms.String()
+			ip.Ms = ms.Milliseconds()
+			level, err := ip.Judge(ctx)
+			if err != nil {
+				gt.Error("匿名度检测失败: ", err)
+			} else {
+				ip.Anonymity = level
+				ip.RecordExit()
+			}
+			ip.EnrichGeo()
+			ip.CheckSites(ctx)
+			if ip.BandwidthDue() {
+				ip.measureBandwidth(ctx, &checkLog)
+			}
+			if ip.SecurityDue() {
+				ip.CheckSecurity(ctx)
+			}
+		}
+	}
+	// 程序退出时中断的检查不算失败，计划时间没变，重启后照常检查
+	// 复活检查中断的退回墓地，不然重启后就离开墓地当成普通ip检查了
+	if ctx.Err() != nil {
+		if resurrect {
+			backToGraveyard(p, v)
+		}
+		return ctx.Err()
+	}
 
-	ctx, err := gt.Get("https://www.doubao.com/chat/", gt.ProxyUrl(ip), gt.ReqTimeOut(30))
+	// 检查期间可能被分配、归还或者收到使用方反馈，把检查结果合并到池子里最新的记录上
+	unlock := lockIP(ip.IP)
+	cur, ok, rErr := BadgerReadStruct(p, ip.IP)
+	if rErr != nil || !ok {
+		unlock()
+		if rErr != nil {
+			plan.Set(ip.IP, time.Now().Unix()+checkRetryDelay)
+		}
+		return rErr
+	}
+	cur.applyCheck(ip)
+	ip = cur
 	if err != nil {
+		checkLog.Fail = FailClass(err)
+		n := ip.RecordFail(checkLog.Fail)
+		gt.Info(ip.IP, " 检查失败 分类:", checkLog.Fail, " 连续:", n, " 总计:", ip.FailNum)
+	} else {
+		ip.RecordSuccess()
+	}
+	checkLog.OK = err == nil
+	if checkLog.OK {
+		checkLog.Ms = ip.Ms
+	}
+	ip.AddHistory(checkLog)
+	to, reason := ip.checkedState(err)
+	if resurrect {
+		if err != nil {
+			to, reason = StateDead, "复活检查失败"
+		} else {
+			gt.Info(ip.IP, " 复活检查通过，离开墓地")
+			ip.DeadTime = 0
+		}
+	}
+	if tErr := ip.Transition(to, reason); tErr != nil {
+		gt.Error(tErr)
+	}
+	if ip.State == StateDead {
+		if !resurrect {
+			gt.Info(ip.IP, " 连续失败 ", ip.ConsecutiveFail, " 次 ", ip.LastFailClass, " 连续 ", ip.ConsecutiveClassFail, " 次,标记为死亡，放入墓地")
+			ip.DeadTime = ip.StateTime
+		}
+		ip.bury()
+		err = ErrDead
+	} else {
+		ip.UpdateScore()
+		ip.NextCheckTime = time.Now().Add(ip.nextCheckInterval()).Unix()
+		plan.Set(ip.IP, ip.NextCheckTime)
+	}
+	if uErr := BadgerUpsertStruct(p, ip.IP, ip); uErr != nil {
+		gt.Error(uErr)
+	}
+	// 放开锁再回调的话，这期间ip可能被分配出去，回调按旧状态放回未使用就会分配两次
+	runCheckHooks(ip, err)
+	unlock()
+	return err
+}
+
+// backToGraveyard 中断的复活检查把状态改回死亡，死亡时间和计划时间都不变
+func backToGraveyard(dbPath, v string) {
+	unlock := lockIP(v)
+	defer unlock()
+	ip, ok, err := BadgerReadStruct(dbPath, v)
+	if err != nil || !ok || ip.State != StateValidating {
+		return
+	}
+	if err := ip.Transition(StateDead, "复活检查中断"); err != nil {
 		gt.Error(err)
-		return err.Error()
+		return
 	}
-	gt.Info(ctx.Ms)
-	gt.Info(ctx.RespBodyString())
-	return ctx.RespBodyString() + "  ms:" + ctx.Ms.String()
+	if err := BadgerUpsertStruct(dbPath, v, ip); err != nil {
+		gt.Error(err)
+	}
+}
+
+// applyCheck 把检查测出来的字段写到池子里最新的记录上
+// 计数、检查记录、状态和域名禁用这些别的地方也会改的字段不动，以最新的为准
+func (p *ProxyIP) applyCheck(from *ProxyIP) {
+	p.Type = from.Type
+	p.Protocols = from.Protocols
+	p.LastCheckTime = from.LastCheckTime
+	p.CheckNum = from.CheckNum
+	p.LastCheckMs = from.LastCheckMs
+	p.Ms = from.Ms
+	p.Anonymity = from.Anonymity
+	p.Site = from.Site
+	p.Sites = from.Sites
+	p.ExitIP = from.ExitIP
+	p.Geo = from.Geo
+	p.ExitGeo = from.ExitGeo
+	p.Kbps = from.Kbps
+	p.TTFBMs = from.TTFBMs
+	p.BandwidthTime = from.BandwidthTime
+	p.Intercepted = from.Intercepted
+	p.Tampered = from.Tampered
+	p.SecurityNote = from.SecurityNote
+	p.SecurityTime = from.SecurityTime
+	p.ExitIPs = from.ExitIPs
+	p.Backconnect = from.Backconnect
+	p.Rotating = from.Rotating
 }
 
-func CheckMs(ip string) (string, error) {
-	if !strings.HasPrefix(ip, "http://") && !strings.HasPrefix(ip, "https://") {
-		ip = "http://" + ip
+// checkedState 按检查结果决定下一个状态，已分配的ip只有死亡和隔离会改变状态
+// 拦截或篡改的ip检查通过仍然是可用，分配时由筛选条件排除，/get?insecure=1 可以分到
+func (p *ProxyIP) checkedState(err error) (string, string) {
+	switch {
+	case err != nil && p.ShouldDelete():
+		return StateDead, p.LastFailClass + " 连续失败"
+	case err != nil && p.LastFailClass == FailBanned:
+		return StateQuarantined, "被封"
+	case p.State == StateLeased:
+		return StateLeased, ""
+	case err != nil:
+		return StateCooling, p.LastFailClass
+	}
+	return StateAvailable, "检查通过"
+}
+
+// 读取池子里的记录，拿到代理类型后才知道用什么方式拨号
+func getOrNew(ip string) *ProxyIP {
+	p, ok, err := Get(ip)
+	if err != nil || !ok {
+		return &ProxyIP{IP: ip}
+	}
+	return p
+}
+
+// get 通过代理发起 GET 请求，ctx 取消时请求立即中断
+func (p *ProxyIP) get(ctx context.Context, caseUrl string, timeout time.Duration) (*gt.Context, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, caseUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	c := gt.Req(req, p.Client(timeout))
+	c.Do()
+	return c, c.Err
+}
+
+func Check(ctx context.Context, ip string) string {
+	p := getOrNew(ip)
+	if len(p.Protocols) == 0 {
+		p.DetectProtocols(ctx)
 	}
 
 	// https://myip.ipip.net
-	gt.Info("Check ", ip)
 
-	ctx, err := gt.Get("https://www.doubao.com/chat/", gt.ProxyUrl(ip), gt.ReqTimeOut(10))
+	c, err := p.get(ctx, "https://www.doubao.com/chat/", 30*time.Second)
 	if err != nil {
 		gt.Error(err)
-		return "", err
+		return err.Error()
+	}
+	gt.Info(c.Ms)
+	gt.Info(c.RespBodyString())
+	return p.RedactedUrl() + "  " + c.RespBodyString() + "  ms:" + c.Ms.String()
+}
+
+// CheckMs 通过代理请求检查地址，返回响应时间
+func (p *ProxyIP) CheckMs(ctx context.Context) (time.Duration, error) {
+	// https://myip.ipip.net
+	gt.Info("Check ", p.Addr())
+
+	c, err := p.get(ctx, "https://www.doubao.com/chat/", 10*time.Second)
+	if err != nil {
+		gt.Error(err)
+		return 0, err
+	}
+	gt.Info(c.Ms)
+	//gt.Info(c.RespBodyString())
+	if err := statusError(c.StateCode, c.RespBody); err != nil {
+		return 0, err
 	}
-	gt.Info(ctx.Ms)
-	//gt.Info(ctx.RespBodyString())
-	return ctx.Ms.String(), nil
+	return c.Ms, nil
 }
@@ -0,0 +1,202 @@
+package pool
+
+import (
+	"FreeProxyMange/conf"
+	"context"
+	"errors"
+	"hash/fnv"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// 在临时目录里跑，池子、租约都写到临时目录，yaml 不为空时写成配置文件
+func useTestDir(t *testing.T, yaml string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		CloseDB()
+		// 下一个测试换了目录还要重新打开
+		ReopenDB()
+		_ = os.Chdir(wd)
+	})
+	if err := os.WriteFile(conf.Path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf.Init()
+}
+
+// 接受连接后拖一会再断开的代理，用来让检查停在请求中间
+func newSlowProxy(t *testing.T, hold time.Duration) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				time.Sleep(hold)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	t.Cleanup(func() { _ = ln.Close() })
+	return ln.Addr().String()
+}
+
+func putTestIP(t *testing.T, p *ProxyIP) {
+	t.Helper()
+	if err := BadgerUpsertStruct(DBPath(p.IP), p.IP, p); err != nil {
+		t.Fatal(err)
+	}
+	stateIndex.Set(p.IP, p.State)
+}
+
+// 检查期间收到的使用方反馈不能被检查结果覆盖
+func TestCheckKeepsConcurrentFeedback(t *testing.T) {
+	useTestDir(t, "")
+	addr := newSlowProxy(t, 300*time.Millisecond)
+	putTestIP(t, &ProxyIP{IP: addr, Type: ProtocolHttp, Protocols: []string{ProtocolHttp}, State: StateAvailable})
+
+	done := make(chan error, 1)
+	go func() { done <- checkOne(context.Background(), addr) }()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := ApplyFeedback(addr, &Feedback{Outcome: FeedbackTimeout, Domain: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err == nil {
+		t.Fatal("连不上的代理检查应该失败")
+	}
+
+	p, ok, err := Get(addr)
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if len(p.History) != 2 || p.History[0].Source != "feedback" || p.History[1].Source != "" {
+		t.Fatalf("检查记录 = %+v", p.History)
+	}
+	if p.FailNum != 2 || p.ConsecutiveFail != 2 {
+		t.Fatalf("失败次数 = %d 连续 = %d", p.FailNum, p.ConsecutiveFail)
+	}
+	if p.State != StateCooling {
+		t.Fatalf("状态 = %s", p.State)
+	}
+}
+
+func TestApplyCheck(t *testing.T) {
+	cur := &ProxyIP{
+		IP:         "1.2.3.4:80",
+		State:      StateLeased,
+		History:    []CheckLog{{Source: "feedback"}},
+		FailNum:    3,
+		DomainBans: map[string]int64{"a.com": 1},
+	}
+	checked := &ProxyIP{IP: "1.2.3.4:80", State: StateValidating, Ms: 120, Anonymity: AnonymityElite, Kbps: 800, ExitIP: "5.6.7.8"}
+	cur.applyCheck(checked)
+	if cur.Ms != 120 || cur.Anonymity != AnonymityElite || cur.Kbps != 800 || cur.ExitIP != "5.6.7.8" {
+		t.Fatalf("检查结果没有合并: %+v", cur)
+	}
+	if cur.State != StateLeased || len(cur.History) != 1 || cur.FailNum != 3 || len(cur.DomainBans) != 1 {
+		t.Fatalf("最新记录的字段被覆盖: %+v", cur)
+	}
+}
+
+func TestCheckedState(t *testing.T) {
+	useTestDir(t, "")
+	banned := &CheckError{Class: FailBanned, Err: errors.New("403")}
+	timeout := &CheckError{Class: FailTimeout, Err: errors.New("超时")}
+	cases := []struct {
+		name string
+		ip   ProxyIP
+		err  error
+		want string
+	}{
+		{"检查通过", ProxyIP{State: StateValidating}, nil, StateAvailable},
+		// 拦截篡改的保持可用，由分配时的筛选条件决定给不给
+		{"篡改内容", ProxyIP{State: StateValidating, Tampered: true}, nil, StateAvailable},
+		{"拦截TLS", ProxyIP{State: StateAvailable, Intercepted: true}, nil, StateAvailable},
+		{"已分配的拦截TLS", ProxyIP{State: StateLeased, Intercepted: true}, nil, StateLeased},
+		{"超时", ProxyIP{State: StateAvailable, LastFailClass: FailTimeout, ConsecutiveFail: 1, ConsecutiveClassFail: 1}, timeout, StateCooling},
+		{"被封", ProxyIP{State: StateLeased, LastFailClass: FailBanned, ConsecutiveFail: 1, ConsecutiveClassFail: 1}, banned, StateQuarantined},
+	}
+	for _, c := range cases {
+		if got, _ := c.ip.checkedState(c.err); got != c.want {
+			t.Errorf("%s: 状态 = %s, 期望 %s", c.name, got, c.want)
+		}
+	}
+}
+
+// 回调在ip锁内执行，期间分配、归还改不了状态
+func TestCheckHookHoldsLock(t *testing.T) {
+	useTestDir(t, "")
+	addr := newSlowProxy(t, 0)
+	putTestIP(t, &ProxyIP{IP: addr, Type: ProtocolHttp, Protocols: []string{ProtocolHttp}, State: StateAvailable})
+
+	checkHooksLock.Lock()
+	saved := checkHooks
+	checkHooksLock.Unlock()
+	t.Cleanup(func() {
+		checkHooksLock.Lock()
+		checkHooks = saved
+		checkHooksLock.Unlock()
+	})
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(addr))
+	l := &ipLocks[hash.Sum32()%uint32(len(ipLocks))]
+	var locked bool
+	var state string
+	checkHooks = []CheckHook{func(ip *ProxyIP, err error) {
+		locked = !l.TryLock()
+		if !locked {
+			l.Unlock()
+		}
+		state = ip.State
+	}}
+	_ = checkOne(context.Background(), addr)
+	if !locked {
+		t.Fatal("回调时没有持有ip锁")
+	}
+	if state != StateCooling {
+		t.Fatalf("回调拿到的状态 = %s", state)
+	}
+}
+
+// 复活检查被中断要留在墓地里
+func TestResurrectCanceledStaysDead(t *testing.T) {
+	useTestDir(t, "")
+	addr := newSlowProxy(t, time.Second)
+	now := time.Now().Unix()
+	putTestIP(t, &ProxyIP{IP: addr, Type: ProtocolHttp, Protocols: []string{ProtocolHttp}, State: StateDead, StateTime: now, DeadTime: now})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	if err := checkOne(ctx, addr); err == nil {
+		t.Fatal("中断的检查应该返回错误")
+	}
+	p, ok, err := Get(addr)
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if p.State != StateDead || p.DeadTime != now {
+		t.Fatalf("状态 = %s 死亡时间 = %d", p.State, p.DeadTime)
+	}
+	if len(p.History) != 0 {
+		t.Fatalf("中断的检查不算失败: %+v", p.History)
+	}
+}
@@ -0,0 +1,61 @@
+package pool
+
+import (
+	"FreeProxyMange/conf"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+按需补充:
+target 有请求在等待但没有可分配的ip时调用 Demand
+1. 冷却中的ip按分数挑 demandCheckSize(默认 20) 个马上检查，检查通过就能分配
+2. 回调 AddDemandHook 注册的函数，collect 用它马上采集一次
+3. demandInterval(默认 30s) 内只触发一次，避免等待的请求多时把检查和采集打满
+
+*/
+
+// DemandHook 需要补充ip时的回调，不能阻塞
+type DemandHook func()
+
+var (
+	demandHooks     []DemandHook
+	demandHooksLock sync.RWMutex
+	lastDemand      atomic.Int64
+)
+
+func AddDemandHook(hook DemandHook) {
+	demandHooksLock.Lock()
+	defer demandHooksLock.Unlock()
+	demandHooks = append(demandHooks, hook)
+}
+
+// Demand 触发一次按需检查和采集，间隔内已经触发过返回 false
+func Demand() bool {
+	now := time.Now().UnixNano()
+	last := lastDemand.Load()
+	if now-last < int64(conf.Duration("demandInterval", 30*time.Second)) || !lastDemand.CompareAndSwap(last, now) {
+		return false
+	}
+
+	ips := IPsInState(StateCooling)
+	SortByScore(ips)
+	if size := conf.Int("demandCheckSize", 20); len(ips) > size {
+		ips = ips[:size]
+	}
+	for _, ip := range ips {
+		CheckSoon(ip)
+	}
+	gt.Info("没有可分配的ip，按需检查冷却中的ip ", len(ips), " 个")
+
+	demandHooksLock.RLock()
+	defer demandHooksLock.RUnlock()
+	for _, hook := range demandHooks {
+		hook()
+	}
+	return true
+}
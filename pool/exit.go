@@ -0,0 +1,173 @@
+package pool
+
+import (
+	"FreeProxyMange/conf"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+
+出口IP:
+很多代理连接的IP和目标网站看到的IP不是同一个，有的每次请求都换出口
+1. 每次检查记录判官看到的出口IP，保留最近 exitHistorySize 个不同的出口，默认 10
+2. 出口和入口不是同一个IP的标记为 Backconnect
+3. exitRotateWindow 时间内见过 exitRotateCount 个以上不同出口的标记为 Rotating，默认 24h 内 3 个
+4. 出口固定的代理按出口IP分组，分配时同一个出口同时只分配一个，避免给出去的"不同"代理在目标看来是同一个
+   轮换出口的代理出口不固定，不参与分组
+
+*/
+
+// ExitRecord 观察到的一个出口IP
+type ExitRecord struct {
+	IP        string `json:"ip"`
+	FirstSeen int64  `json:"firstSeen"`
+	LastSeen  int64  `json:"lastSeen"`
+	Count     int    `json:"count"`
+}
+
+// RecordExit 记录这次检查看到的出口IP，更新 Backconnect 和 Rotating 标记
+func (p *ProxyIP) RecordExit() {
+	if p.ExitIP == "" {
+		return
+	}
+	now := time.Now().Unix()
+	current := ExitRecord{IP: p.ExitIP, FirstSeen: now}
+	rest := make([]ExitRecord, 0, len(p.ExitIPs))
+	for _, e := range p.ExitIPs {
+		if e.IP == p.ExitIP {
+			current = e
+			continue
+		}
+		rest = append(rest, e)
+	}
+	current.LastSeen = now
+	current.Count++
+	// 这次看到的放在最前面，时间只精确到秒，同一秒里的几次检查按时间排不出先后
+	sort.SliceStable(rest, func(i, j int) bool {
+		return rest[i].LastSeen > rest[j].LastSeen
+	})
+	p.ExitIPs = append([]ExitRecord{current}, rest...)
+	// 超出数量丢掉最久没见过的
+	if size := conf.Int("exitHistorySize", 10); size > 0 && len(p.ExitIPs) > size {
+		p.ExitIPs = p.ExitIPs[:size]
+	}
+
+	p.Backconnect = p.ExitIP != p.host()
+	window := conf.Duration("exitRotateWindow", 24*time.Hour)
+	recent := 0
+	for _, e := range p.ExitIPs {
+		if time.Since(time.Unix(e.LastSeen, 0)) <= window {
+			recent++
+		}
+	}
+	p.Rotating = recent >= conf.Int("exitRotateCount", 3)
+	exitIndex.Update(p)
+}
+
+// ExitKey 分组用的出口IP，轮换出口的代理返回空
+func (p *ProxyIP) ExitKey() string {
+	if p.Rotating {
+		return ""
+	}
+	return p.ExitIP
+}
+
+// 入口IP，不带端口
+func (p *ProxyIP) host() string {
+	if h, _, err := net.SplitHostPort(p.Addr()); err == nil {
+		return h
+	}
+	return p.Addr()
+}
+
+// 出口IP -> 入口代理 的内存索引
+type exitIndexMap struct {
+	lock   sync.RWMutex
+	groups map[string]map[string]struct{}
+	byIP   map[string]string
+}
+
+var exitIndex = &exitIndexMap{
+	groups: make(map[string]map[string]struct{}),
+	byIP:   make(map[string]string),
+}
+
+func (e *exitIndexMap) Update(p *ProxyIP) {
+	exit := p.ExitKey()
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.remove(p.IP)
+	if exit == "" {
+		return
+	}
+	if e.groups[exit] == nil {
+		e.groups[exit] = make(map[string]struct{})
+	}
+	e.groups[exit][p.IP] = struct{}{}
+	e.byIP[p.IP] = exit
+}
+
+func (e *exitIndexMap) Remove(ip string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.remove(ip)
+}
+
+func (e *exitIndexMap) remove(ip string) {
+	old, ok := e.byIP[ip]
+	if !ok {
+		return
+	}
+	delete(e.groups[old], ip)
+	if len(e.groups[old]) == 0 {
+		delete(e.groups, old)
+	}
+	delete(e.byIP, ip)
+}
+
+// ExitOf 代理当前固定的出口IP，轮换或没检查过返回空
+func ExitOf(ip string) string {
+	exitIndex.lock.RLock()
+	defer exitIndex.lock.RUnlock()
+	return exitIndex.byIP[ip]
+}
+
+// SameExit 和 ip 共用同一个出口的其他代理
+func SameExit(ip string) []string {
+	exitIndex.lock.RLock()
+	defer exitIndex.lock.RUnlock()
+	exit, ok := exitIndex.byIP[ip]
+	if !ok {
+		return nil
+	}
+	ips := make([]string, 0, len(exitIndex.groups[exit]))
+	for v := range exitIndex.groups[exit] {
+		if v != ip {
+			ips = append(ips, v)
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// ExitGroups 多个入口共用同一个出口的分组，key 为出口IP
+func ExitGroups() map[string][]string {
+	exitIndex.lock.RLock()
+	defer exitIndex.lock.RUnlock()
+	groups := make(map[string][]string)
+	for exit, set := range exitIndex.groups {
+		if len(set) < 2 {
+			continue
+		}
+		ips := make([]string, 0, len(set))
+		for ip := range set {
+			ips = append(ips, ip)
+		}
+		SortByScore(ips)
+		groups[exit] = ips
+	}
+	return groups
+}
@@ -0,0 +1,105 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 判官返回的 origin 当作出口IP，next 每次请求返回一个
+func newTestJudge(t *testing.T, next func() string) string {
+	t.Helper()
+	judge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"origin":%q,"headers":{}}`, next())
+	}))
+	t.Cleanup(judge.Close)
+	return judge.URL + "/get"
+}
+
+func forgetExits(t *testing.T, ips ...*ProxyIP) {
+	t.Cleanup(func() {
+		for _, ip := range ips {
+			exitIndex.Remove(ip.IP)
+		}
+	})
+}
+
+// 两个入口经过判官看到同一个出口，按出口分组
+func TestRecordExitSameExit(t *testing.T) {
+	judgeUrl := newTestJudge(t, func() string { return "203.0.113.7" })
+	useTestDir(t, "realIP: 9.9.9.9\njudgeUrl: "+judgeUrl+"\n")
+
+	a := &ProxyIP{IP: newTestProxy(t, nil), Type: ProtocolHttp}
+	b := &ProxyIP{IP: newTestProxy(t, nil), Type: ProtocolHttp}
+	forgetExits(t, a, b)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, p := range []*ProxyIP{a, b} {
+		if _, err := p.Judge(ctx); err != nil {
+			t.Fatal(err)
+		}
+		p.RecordExit()
+	}
+
+	if a.ExitIP != "203.0.113.7" || !a.Backconnect || a.Rotating {
+		t.Fatalf("exit=%s backconnect=%v rotating=%v", a.ExitIP, a.Backconnect, a.Rotating)
+	}
+	if ExitOf(a.IP) != "203.0.113.7" || ExitOf(b.IP) != "203.0.113.7" {
+		t.Fatalf("ExitOf = %q %q", ExitOf(a.IP), ExitOf(b.IP))
+	}
+	if same := SameExit(a.IP); len(same) != 1 || same[0] != b.IP {
+		t.Fatalf("SameExit = %v", same)
+	}
+	if group := ExitGroups()["203.0.113.7"]; len(group) != 2 {
+		t.Fatalf("ExitGroups = %v", ExitGroups())
+	}
+
+	// 入口不在了从分组里去掉
+	exitIndex.Remove(b.IP)
+	if same := SameExit(a.IP); len(same) != 0 {
+		t.Fatalf("删除后 SameExit = %v", same)
+	}
+}
+
+// 出口每次都换的标记为轮换，不参与分组
+func TestRecordExitRotating(t *testing.T) {
+	var n atomic.Int32
+	judgeUrl := newTestJudge(t, func() string { return fmt.Sprintf("198.51.100.%d", n.Add(1)) })
+	useTestDir(t, "realIP: 9.9.9.9\njudgeUrl: "+judgeUrl+"\nexitRotateCount: 3\nexitHistorySize: 2\n")
+
+	p := &ProxyIP{IP: newTestProxy(t, nil), Type: ProtocolHttp}
+	forgetExits(t, p)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	check := func() {
+		t.Helper()
+		if _, err := p.Judge(ctx); err != nil {
+			t.Fatal(err)
+		}
+		p.RecordExit()
+	}
+
+	check()
+	if p.Rotating || ExitOf(p.IP) != "198.51.100.1" {
+		t.Fatalf("第一次: rotating=%v exit=%q", p.Rotating, ExitOf(p.IP))
+	}
+	check()
+	if len(p.ExitIPs) != 2 || p.ExitIPs[0].IP != "198.51.100.2" {
+		t.Fatalf("出口记录 = %+v", p.ExitIPs)
+	}
+	// 只保留 2 个出口记录，到不了 3 个不算轮换
+	check()
+	if p.Rotating || len(p.ExitIPs) != 2 {
+		t.Fatalf("保留 2 个记录时: rotating=%v %+v", p.Rotating, p.ExitIPs)
+	}
+
+	useTestDir(t, "realIP: 9.9.9.9\njudgeUrl: "+judgeUrl+"\nexitRotateCount: 3\n")
+	check()
+	if !p.Rotating || p.ExitKey() != "" || ExitOf(p.IP) != "" {
+		t.Fatalf("轮换出口: rotating=%v exitKey=%q ExitOf=%q", p.Rotating, p.ExitKey(), ExitOf(p.IP))
+	}
+}
@@ -0,0 +1,226 @@
+package pool
+
+import (
+	"FreeProxyMange/conf"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+检查失败分类:
+每次检查失败都归到一类，记录到检查记录里，总失败次数和连续失败次数分开统计
+dns        域名解析失败
+refused    连接被拒绝，socks 代理拒绝请求也算
+timeout    连接或读取超时
+tls        TLS 握手失败、证书错误
+auth       407 或 socks 认证失败，需要账号密码
+proxy5xx   代理返回 5xx
+body       返回了非预期的状态码或内容
+banned     返回 403 429，被目标网站封了
+other      其他错误
+
+几类失败交替出现时每一类都到不了分类的上限，这种混合的连续失败 maxConsecutiveFail(默认 5) 次删除，0 表示不限制
+连续失败都是同一类时只按这一类的策略，timeout 的 delete 为 10、banned 的 delete 为 0 不受它影响
+每一类可以单独配置删除和退避策略 failPolicy:
+delete   同一类连续失败多少次删除，0 表示这一类不删除
+backoff  这一类失败后重试间隔的起点，按连续失败次数指数退避，不配置用 checkFailInterval
+
+*/
+
+const (
+	FailDNS      = "dns"
+	FailRefused  = "refused"
+	FailTimeout  = "timeout"
+	FailTLS      = "tls"
+	FailAuth     = "auth"
+	FailProxy5xx = "proxy5xx"
+	FailBody     = "body"
+	FailBanned   = "banned"
+	FailOther    = "other"
+)
+
+// CheckError 带分类的检查错误
+type CheckError struct {
+	Class string
+	Err   error
+}
+
+func (e *CheckError) Error() string {
+	return e.Class + ": " + e.Err.Error()
+}
+
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
+
+func newCheckError(class string, format string, args ...interface{}) *CheckError {
+	return &CheckError{Class: class, Err: fmt.Errorf(format, args...)}
+}
+
+// FailClass 错误的分类，nil 返回空
+func FailClass(err error) string {
+	if err == nil {
+		return ""
+	}
+	var checkErr *CheckError
+	if errors.As(err, &checkErr) {
+		return checkErr.Class
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return FailDNS
+	}
+	if errors.Is(err, ErrSocksNeedAuth) || errors.Is(err, ErrSocksAuthFailed) {
+		return FailAuth
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, ErrSocksReply) || errors.Is(err, ErrNoProtocol) {
+		return FailRefused
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return FailTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return FailTimeout
+	}
+
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	if errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &certErr) ||
+		errors.As(err, &unknownAuthErr) || errors.As(err, &hostErr) {
+		return FailTLS
+	}
+
+	// CONNECT 失败时标准库只返回状态行，只能按文本判断
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "Proxy Authentication Required"):
+		return FailAuth
+	case strings.Contains(msg, "tls:") || strings.Contains(msg, "x509:"):
+		return FailTLS
+	case strings.Contains(msg, "connection refused"):
+		return FailRefused
+	case strings.Contains(msg, "Client.Timeout exceeded") || strings.Contains(msg, "i/o timeout"):
+		return FailTimeout
+	case strings.Contains(msg, "proxyconnect") && (strings.Contains(msg, " 50") || strings.Contains(msg, "Bad Gateway")):
+		return FailProxy5xx
+	}
+	return FailOther
+}
+
+// statusError 按状态码判断检查是否失败，正常返回 nil
+func statusError(code int, body []byte) error {
+	switch {
+	case code == 407:
+		return newCheckError(FailAuth, "返回状态码 %d", code)
+	case code == 403 || code == 429:
+		return newCheckError(FailBanned, "返回状态码 %d", code)
+	case code >= 500:
+		return newCheckError(FailProxy5xx, "返回状态码 %d", code)
+	case code >= 400 || code < 200:
+		return newCheckError(FailBody, "返回状态码 %d", code)
+	case code < 300 && len(body) == 0:
+		return newCheckError(FailBody, "返回内容为空")
+	}
+	return nil
+}
+
+// FailPolicy 一类失败的处理策略
+type FailPolicy struct {
+	Delete  int           // 同一类连续失败多少次删除，0 不删除
+	Backoff time.Duration // 重试间隔起点，0 使用 checkFailInterval
+}
+
+// 默认策略: 连不上的很快删除，超时和被封的只退避
+var defaultFailPolicy = map[string]FailPolicy{
+	FailDNS:      {Delete: 3},
+	FailRefused:  {Delete: 3},
+	FailTimeout:  {Delete: 10, Backoff: 2 * time.Minute},
+	FailTLS:      {Delete: 5},
+	FailAuth:     {Delete: 2},
+	FailProxy5xx: {Delete: 5},
+	FailBody:     {Delete: 5},
+	FailBanned:   {Delete: 0, Backoff: 10 * time.Minute},
+	FailOther:    {Delete: 5},
+}
+
+// GetFailPolicy 配置文件 failPolicy 里配置了的项覆盖默认值
+func GetFailPolicy(class string) FailPolicy {
+	policy, ok := defaultFailPolicy[class]
+	if !ok {
+		policy = defaultFailPolicy[FailOther]
+	}
+	all, ok := conf.Get("failPolicy").(map[string]interface{})
+	if !ok {
+		return policy
+	}
+	item, ok := all[class].(map[string]interface{})
+	if !ok {
+		return policy
+	}
+	if v, ok := item["delete"]; ok {
+		policy.Delete = gt.Any2Int(v)
+	}
+	if v, ok := item["backoff"]; ok {
+		d, err := time.ParseDuration(gt.Any2String(v))
+		if err != nil {
+			d = time.Duration(gt.Any2Int(v)) * time.Second
+		}
+		policy.Backoff = d
+	}
+	return policy
+}
+
+// RecordFail 记录一次失败，返回这一类的连续失败次数
+func (p *ProxyIP) RecordFail(class string) int {
+	p.FailNum++
+	p.ConsecutiveFail++
+	p.ConsecutiveSuccess = 0
+	if p.FailClassNum == nil {
+		p.FailClassNum = make(map[string]int)
+	}
+	p.FailClassNum[class]++
+	if p.LastFailClass == class {
+		p.ConsecutiveClassFail++
+	} else {
+		p.LastFailClass = class
+		p.ConsecutiveClassFail = 1
+	}
+	return p.ConsecutiveClassFail
+}
+
+// RecordSuccess 记录一次成功，清空连续失败
+func (p *ProxyIP) RecordSuccess() {
+	p.ConsecutiveSuccess++
+	p.ConsecutiveFail = 0
+	p.ConsecutiveClassFail = 0
+	p.LastFailClass = ""
+}
+
+// ShouldDelete 按最近一次失败分类的策略判断是否该删除，混合了几类的连续失败超过总上限也删除
+func (p *ProxyIP) ShouldDelete() bool {
+	if p.ConsecutiveFail == 0 {
+		return false
+	}
+	mixed := p.ConsecutiveFail > p.ConsecutiveClassFail
+	if max := conf.Int("maxConsecutiveFail", 5); mixed && max > 0 && p.ConsecutiveFail >= max {
+		return true
+	}
+	policy := GetFailPolicy(p.LastFailClass)
+	return policy.Delete > 0 && p.ConsecutiveClassFail >= policy.Delete
+}
@@ -0,0 +1,73 @@
+package pool
+
+import "testing"
+
+func TestShouldDelete(t *testing.T) {
+	useTestDir(t, "")
+	repeat := func(class string, n int) []string {
+		list := make([]string, n)
+		for i := range list {
+			list[i] = class
+		}
+		return list
+	}
+	cases := []struct {
+		name  string
+		fails []string
+		want  bool
+	}{
+		{"没有失败", nil, false},
+		{"同一类达到分类上限", repeat(FailRefused, 3), true},
+		{"同一类没到分类上限", repeat(FailRefused, 2), false},
+		{"timeout 没到 10 次", repeat(FailTimeout, 9), false},
+		{"timeout 达到 10 次", repeat(FailTimeout, 10), true},
+		{"banned 不删除", repeat(FailBanned, 20), false},
+		{"不同分类交替达到总上限", []string{FailRefused, FailTimeout, FailRefused, FailTimeout, FailRefused}, true},
+		{"不同分类交替没到总上限", []string{FailRefused, FailTimeout, FailRefused, FailTimeout}, false},
+		{"混合后同一类达到分类上限", append([]string{FailTimeout}, repeat(FailAuth, 2)...), true},
+	}
+	for _, c := range cases {
+		p := &ProxyIP{}
+		for _, class := range c.fails {
+			p.RecordFail(class)
+		}
+		if got := p.ShouldDelete(); got != c.want {
+			t.Errorf("%s: ShouldDelete = %v, 期望 %v", c.name, got, c.want)
+		}
+	}
+
+	// 中间成功一次清空连续失败
+	p := &ProxyIP{}
+	for _, class := range []string{FailRefused, FailTimeout, FailRefused, FailTimeout} {
+		p.RecordFail(class)
+	}
+	p.RecordSuccess()
+	p.RecordFail(FailRefused)
+	if p.ShouldDelete() {
+		t.Fatal("成功之后连续失败应该重新计数")
+	}
+}
+
+func TestShouldDeleteConfigured(t *testing.T) {
+	useTestDir(t, "maxConsecutiveFail: 0\n"+
+		"failPolicy:\n  timeout: {delete: 3}\n  banned: {delete: 4}\n")
+	cases := []struct {
+		name  string
+		fails []string
+		want  bool
+	}{
+		{"timeout 配置成 3 次", []string{FailTimeout, FailTimeout, FailTimeout}, true},
+		{"banned 配置成 4 次", []string{FailBanned, FailBanned, FailBanned}, false},
+		{"banned 达到 4 次", []string{FailBanned, FailBanned, FailBanned, FailBanned}, true},
+		{"总上限为 0 时交替不删除", []string{FailRefused, FailTimeout, FailRefused, FailTimeout, FailRefused, FailTimeout}, false},
+	}
+	for _, c := range cases {
+		p := &ProxyIP{}
+		for _, class := range c.fails {
+			p.RecordFail(class)
+		}
+		if got := p.ShouldDelete(); got != c.want {
+			t.Errorf("%s: ShouldDelete = %v, 期望 %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package pool
+
+import (
+	"FreeProxyMange/conf"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+使用方反馈:
+使用方用代理访问目标网站的结果，和检查结果一样记入检查记录、失败分类和质量分
+1. success  正常
+2. failed   请求失败，按状态码分类，状态码为 0 (没有响应)算连接失败，马上安排检查
+3. timeout  超时，马上安排检查
+4. banned / captcha  被目标网站封了或者出了验证码
+   scope=global 整个ip隔离，scope=domain(默认) 只在这个域名上禁用 feedbackDomainBan(默认 30m)
+   新入池和冷却中的ip经过检查中再隔离，死亡的ip不变
+
+*/
+
+const (
+	FeedbackSuccess = "success"
+	FeedbackFailed  = "failed"
+	FeedbackTimeout = "timeout"
+	FeedbackBanned  = "banned"
+	FeedbackCaptcha = "captcha"
+
+	ScopeDomain = "domain"
+	ScopeGlobal = "global"
+)
+
+var ErrFeedbackOutcome = errors.New("outcome 只支持 success failed timeout banned captcha")
+
+// Feedback 一次使用结果
+type Feedback struct {
+	Proxy   string `json:"proxy"`   // ip:port 或者 /get 返回的代理地址
+	LeaseID string `json:"leaseId"` // 可以只传租约 ID
+	Domain  string `json:"domain"`  // 目标域名
+	Outcome string `json:"outcome"`
+	Status  int    `json:"status"` // 目标网站返回的状态码，没有响应为 0
+	Ms      int64  `json:"ms"`     // 请求耗时
+	Scope   string `json:"scope"`  // 被封时的影响范围 domain global
+}
+
+func (fb *Feedback) Validate() error {
+	switch fb.Outcome {
+	case FeedbackSuccess, FeedbackFailed, FeedbackTimeout, FeedbackBanned, FeedbackCaptcha:
+	default:
+		return ErrFeedbackOutcome
+	}
+	if fb.Scope == "" {
+		fb.Scope = ScopeDomain
+	}
+	if fb.Scope != ScopeDomain && fb.Scope != ScopeGlobal {
+		return errors.New("scope 只支持 domain global")
+	}
+	fb.Domain = strings.ToLower(strings.TrimSpace(fb.Domain))
+	if fb.Scope == ScopeDomain && fb.Domain == "" && fb.Banned() {
+		return errors.New("scope=domain 时 domain 不能为空")
+	}
+	return nil
+}
+
+func (fb *Feedback) Banned() bool {
+	return fb.Outcome == FeedbackBanned || fb.Outcome == FeedbackCaptcha
+}
+
+// FailClass 反馈对应的失败分类，成功返回空
+func (fb *Feedback) FailClass() string {
+	switch fb.Outcome {
+	case FeedbackSuccess:
+		return ""
+	case FeedbackBanned, FeedbackCaptcha:
+		return FailBanned
+	case FeedbackTimeout:
+		return FailTimeout
+	}
+	// 没有响应是连不上代理或者代理断开了
+	if fb.Status == 0 {
+		return FailRefused
+	}
+	if fb.Status < 200 || fb.Status >= 400 {
+		return FailClass(statusError(fb.Status, nil))
+	}
+	return FailOther
+}
+
+// ApplyFeedback 把反馈记到池子里的记录，返回更新后的记录
+func ApplyFeedback(ip string, fb *Feedback) (*ProxyIP, error) {
+	unlock := lockIP(ip)
+	defer unlock()
+	p, ok, err := Get(ip)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("池子里没有 %s", ip)
+	}
+
+	log := CheckLog{Time: time.Now().Unix(), OK: fb.Outcome == FeedbackSuccess, Source: "feedback", Domain: fb.Domain}
+	if log.OK {
+		log.Ms = fb.Ms
+		p.RecordSuccess()
+	} else {
+		log.Fail = fb.FailClass()
+		p.RecordFail(log.Fail)
+	}
+	p.AddHistory(log)
+
+	checkSoon := false
+	switch {
+	case fb.Banned() && fb.Scope == ScopeGlobal:
+		if err := p.quarantine("使用方反馈被封: " + fb.Domain); err != nil {
+			return nil, err
+		}
+	case fb.Banned():
+		p.BanDomain(fb.Domain, conf.Duration("feedbackDomainBan", 30*time.Minute))
+	case !log.OK:
+		checkSoon = true
+	}
+	p.UpdateScore()
+	if err := BadgerUpsertStruct(DBPath(ip), ip, p); err != nil {
+		return nil, err
+	}
+	if checkSoon {
+		CheckSoon(ip)
+	}
+	gt.Info(ip, " 使用方反馈 ", fb.Domain, " ", fb.Outcome, " 状态码:", fb.Status)
+	return p, nil
+}
+
+// quarantine 隔离整个ip，新入池和冷却中的不能直接隔离，经过检查中再隔离，墓地里的保持死亡
+func (p *ProxyIP) quarantine(reason string) error {
+	if p.State == StateDead {
+		return nil
+	}
+	if !CanTransition(p.State, StateQuarantined) {
+		if err := p.Transition(StateValidating, reason); err != nil {
+			return err
+		}
+	}
+	return p.Transition(StateQuarantined, reason)
+}
+
+// BanDomain 在这个域名上禁用一段时间，顺便清掉已经过期的
+func (p *ProxyIP) BanDomain(domain string, d time.Duration) {
+	now := time.Now().Unix()
+	if p.DomainBans == nil {
+		p.DomainBans = make(map[string]int64)
+	}
+	for k, until := range p.DomainBans {
+		if until <= now {
+			delete(p.DomainBans, k)
+		}
+	}
+	p.DomainBans[domain] = time.Now().Add(d).Unix()
+}
+
+// DomainBanned 在这个域名上是否被禁用
+func (p *ProxyIP) DomainBanned(domain string) bool {
+	if domain == "" {
+		return false
+	}
+	until, ok := p.DomainBans[strings.ToLower(domain)]
+	return ok && until > time.Now().Unix()
+}
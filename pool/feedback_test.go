@@ -0,0 +1,84 @@
+package pool
+
+import "testing"
+
+func TestFeedbackValidate(t *testing.T) {
+	cases := []struct {
+		fb     Feedback
+		ok     bool
+		domain string
+	}{
+		{Feedback{Outcome: FeedbackBanned, Domain: " Example.COM "}, true, "example.com"},
+		{Feedback{Outcome: FeedbackBanned, Domain: "  "}, false, ""},
+		{Feedback{Outcome: FeedbackBanned, Domain: " ", Scope: ScopeGlobal}, true, ""},
+		{Feedback{Outcome: FeedbackFailed}, true, ""},
+		{Feedback{Outcome: "ok"}, false, ""},
+		{Feedback{Outcome: FeedbackSuccess, Scope: "all"}, false, ""},
+	}
+	for _, c := range cases {
+		fb := c.fb
+		err := fb.Validate()
+		if (err == nil) != c.ok {
+			t.Errorf("%+v: err = %v", c.fb, err)
+			continue
+		}
+		if err == nil && fb.Domain != c.domain {
+			t.Errorf("%+v: domain = %q", c.fb, fb.Domain)
+		}
+	}
+}
+
+func TestFeedbackFailClass(t *testing.T) {
+	cases := []struct {
+		outcome string
+		status  int
+		want    string
+	}{
+		{FeedbackSuccess, 200, ""},
+		{FeedbackTimeout, 0, FailTimeout},
+		{FeedbackCaptcha, 200, FailBanned},
+		{FeedbackFailed, 0, FailRefused},
+		{FeedbackFailed, 200, FailOther},
+		{FeedbackFailed, 302, FailOther},
+		{FeedbackFailed, 403, FailBanned},
+		{FeedbackFailed, 407, FailAuth},
+		{FeedbackFailed, 404, FailBody},
+		{FeedbackFailed, 502, FailProxy5xx},
+	}
+	for _, c := range cases {
+		fb := &Feedback{Outcome: c.outcome, Status: c.status}
+		if got := fb.FailClass(); got != c.want {
+			t.Errorf("%s %d: FailClass = %q, 期望 %q", c.outcome, c.status, got, c.want)
+		}
+	}
+}
+
+// scope=global 时各个状态都能隔离，死亡的不动
+func TestFeedbackGlobalBan(t *testing.T) {
+	useTestDir(t, "")
+	cases := []struct {
+		state string
+		want  string
+	}{
+		{StateNew, StateQuarantined},
+		{StateCooling, StateQuarantined},
+		{StateAvailable, StateQuarantined},
+		{StateLeased, StateQuarantined},
+		{StateQuarantined, StateQuarantined},
+		{StateDead, StateDead},
+	}
+	for i, c := range cases {
+		ip := "10.1.0." + string(rune('1'+i)) + ":80"
+		putTestIP(t, &ProxyIP{IP: ip, State: c.state})
+		p, err := ApplyFeedback(ip, &Feedback{Outcome: FeedbackBanned, Scope: ScopeGlobal, Domain: "example.com"})
+		if err != nil {
+			t.Fatalf("%s: %v", c.state, err)
+		}
+		if p.State != c.want {
+			t.Fatalf("%s: 反馈后状态 = %s, 期望 %s", c.state, p.State, c.want)
+		}
+		if got, _, _ := Get(ip); got.State != c.want {
+			t.Fatalf("%s: 池子里的状态 = %s", c.state, got.State)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package pool
+
+import (
+	"FreeProxyMange/conf"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gt "github.com/mangenotwork/gathertool"
+	"github.com/oschwald/geoip2-golang"
+)
+
+/*
+
+GeoIP 和 ASN 信息:
+读取本地的 GeoLite2/GeoIP2 mmdb 文件，不走网络查询
+1. geoipCityDB  GeoLite2-City.mmdb 或 GeoLite2-Country.mmdb 的路径，查国家和城市
+2. geoipAsnDB   GeoLite2-ASN.mmdb 的路径，查 ASN
+文件更新后会自动重新加载，都没配置就不做这一步
+
+代理入口IP的信息存到 Geo，出口IP的信息存到 ExitGeo，
+按国家和 ASN 建立内存索引，筛选时优先用出口IP的信息，因为目标网站看到的是出口IP
+
+*/
+
+type GeoInfo struct {
+	Country string `json:"country"` // ISO 国家代码，例如 CN US
+	City    string `json:"city"`
+	ASN     uint   `json:"asn"`
+	ASOrg   string `json:"asOrg"`
+}
+
+// 一个 mmdb 文件，记录修改时间用于判断是否需要重新加载
+type geoDB struct {
+	lock    sync.RWMutex
+	key     string
+	path    string
+	modTime time.Time
+	reader  *geoip2.Reader
+	checked time.Time
+}
+
+var (
+	geoCityDB = &geoDB{key: "geoipCityDB"}
+	geoAsnDB  = &geoDB{key: "geoipAsnDB"}
+)
+
+// get 返回当前的 reader，每30秒检查一次文件有没有变化，变了就重新加载
+func (g *geoDB) get() *geoip2.Reader {
+	g.lock.RLock()
+	reader, checked := g.reader, g.checked
+	g.lock.RUnlock()
+	if time.Since(checked) < 30*time.Second {
+		return reader
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.checked = time.Now()
+	path := conf.Str(g.key, "")
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		gt.Error("读取 mmdb 文件失败: ", err)
+		return g.reader
+	}
+	if g.reader != nil && path == g.path && info.ModTime().Equal(g.modTime) {
+		return g.reader
+	}
+	newReader, err := geoip2.Open(path)
+	if err != nil {
+		gt.Error("加载 mmdb 文件失败: ", err)
+		return g.reader
+	}
+	// 旧的 reader 可能还有正在进行的查询，交给 GC 回收，不主动关闭
+	g.reader = newReader
+	g.path = path
+	g.modTime = info.ModTime()
+	gt.Info("加载 mmdb 文件: ", path)
+	return g.reader
+}
+
+// LookupGeo 查询IP的国家、城市和 ASN，都没有查到返回 nil
+func LookupGeo(ip string) *GeoInfo {
+	host := ip
+	if h, _, err := net.SplitHostPort(ip); err == nil {
+		host = h
+	}
+	addr := net.ParseIP(host)
+	if addr == nil {
+		return nil
+	}
+
+	info := &GeoInfo{}
+	found := false
+	if reader := geoCityDB.get(); reader != nil {
+		if city, err := reader.City(addr); err == nil && city.Country.IsoCode != "" {
+			info.Country = city.Country.IsoCode
+			info.City = city.City.Names["en"]
+			found = true
+		}
+	}
+	if reader := geoAsnDB.get(); reader != nil {
+		if asn, err := reader.ASN(addr); err == nil && asn.AutonomousSystemNumber != 0 {
+			info.ASN = asn.AutonomousSystemNumber
+			info.ASOrg = asn.AutonomousSystemOrganization
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return info
+}
+
+// EnrichGeo 补充入口IP和出口IP的地理信息，并更新索引
+func (p *ProxyIP) EnrichGeo() {
+	if geo := LookupGeo(p.Addr()); geo != nil {
+		p.Geo = geo
+	}
+	if p.ExitIP != "" {
+		if geo := LookupGeo(p.ExitIP); geo != nil {
+			p.ExitGeo = geo
+		}
+	}
+	geoIndex.Update(p)
+}
+
+// TargetGeo 目标网站看到的地理信息，有出口IP的信息就用出口的
+func (p *ProxyIP) TargetGeo() *GeoInfo {
+	if p.ExitGeo != nil {
+		return p.ExitGeo
+	}
+	return p.Geo
+}
+
+// 国家和 ASN 的内存索引
+type geoIndexMap struct {
+	lock    sync.RWMutex
+	country map[string]map[string]struct{}
+	asn     map[uint]map[string]struct{}
+	byIP    map[string]GeoInfo
+}
+
+var geoIndex = &geoIndexMap{
+	country: make(map[string]map[string]struct{}),
+	asn:     make(map[uint]map[string]struct{}),
+	byIP:    make(map[string]GeoInfo),
+}
+
+func (g *geoIndexMap) Update(p *ProxyIP) {
+	geo := p.TargetGeo()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.remove(p.IP)
+	if geo == nil {
+		return
+	}
+	if geo.Country != "" {
+		if g.country[geo.Country] == nil {
+			g.country[geo.Country] = make(map[string]struct{})
+		}
+		g.country[geo.Country][p.IP] = struct{}{}
+	}
+	if geo.ASN != 0 {
+		if g.asn[geo.ASN] == nil {
+			g.asn[geo.ASN] = make(map[string]struct{})
+		}
+		g.asn[geo.ASN][p.IP] = struct{}{}
+	}
+	g.byIP[p.IP] = *geo
+}
+
+func (g *geoIndexMap) Remove(ip string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.remove(ip)
+}
+
+func (g *geoIndexMap) remove(ip string) {
+	old, ok := g.byIP[ip]
+	if !ok {
+		return
+	}
+	delete(g.country[old.Country], ip)
+	if len(g.country[old.Country]) == 0 {
+		delete(g.country, old.Country)
+	}
+	delete(g.asn[old.ASN], ip)
+	if len(g.asn[old.ASN]) == 0 {
+		delete(g.asn, old.ASN)
+	}
+	delete(g.byIP, ip)
+}
+
+// FindByGeo 按国家和 ASN 查找ip，多个国家或多个 ASN 之间是或，国家和 ASN 之间是且
+func FindByGeo(countries []string, asns []uint) []string {
+	geoIndex.lock.RLock()
+	defer geoIndex.lock.RUnlock()
+
+	var set map[string]struct{}
+	if len(countries) > 0 {
+		set = make(map[string]struct{})
+		for _, c := range countries {
+			for ip := range geoIndex.country[strings.ToUpper(c)] {
+				set[ip] = struct{}{}
+			}
+		}
+	}
+	if len(asns) > 0 {
+		asnSet := make(map[string]struct{})
+		for _, a := range asns {
+			for ip := range geoIndex.asn[a] {
+				if set == nil {
+					asnSet[ip] = struct{}{}
+				} else if _, ok := set[ip]; ok {
+					asnSet[ip] = struct{}{}
+				}
+			}
+		}
+		set = asnSet
+	}
+
+	ips := make([]string, 0, len(set))
+	for ip := range set {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	SortByScore(ips)
+	return ips
+}
+
+// GeoMatch 代理是否符合国家和 ASN 的筛选，空表示不限制
+func (p *ProxyIP) GeoMatch(countries []string, asns []uint) bool {
+	if len(countries) == 0 && len(asns) == 0 {
+		return true
+	}
+	geo := p.TargetGeo()
+	if geo == nil {
+		return false
+	}
+	if len(countries) > 0 {
+		ok := false
+		for _, c := range countries {
+			if strings.EqualFold(c, geo.Country) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(asns) > 0 {
+		for _, a := range asns {
+			if a == geo.ASN {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
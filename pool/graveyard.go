@@ -0,0 +1,77 @@
+package pool
+
+import (
+	"FreeProxyMange/conf"
+	"time"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+墓地:
+死亡的ip不马上删除，在墓地里保留 graveyardKeep(默认 72h)，每 graveyardInterval(默认 1h) 做一次复活检查
+复活检查通过的回到可用，检查记录和历史都保留，没通过的继续留在墓地
+超过保留时间的从池子里彻底删除，之后采集源重新采集到会当作新ip入池
+采集源重新采集到墓地里的ip时马上做一次复活检查
+
+*/
+
+// 复活检查间隔最少 1 分钟，配置成 0 或负数时按最小值
+const minGraveyardInterval = time.Minute
+
+func graveyardInterval() time.Duration {
+	interval := conf.Duration("graveyardInterval", time.Hour)
+	if interval < minGraveyardInterval {
+		return minGraveyardInterval
+	}
+	return interval
+}
+
+func graveyardKeep() time.Duration {
+	return conf.Duration("graveyardKeep", 72*time.Hour)
+}
+
+// 进入墓地的时间
+func (p *ProxyIP) deadSince() time.Time {
+	if p.DeadTime > 0 {
+		return time.Unix(p.DeadTime, 0)
+	}
+	return time.Unix(p.StateTime, 0)
+}
+
+// 死亡时间超过保留时间
+func (p *ProxyIP) graveyardExpired() bool {
+	return time.Since(p.deadSince()) > graveyardKeep()
+}
+
+// 下一次复活检查的时间，按死亡时间对齐，是现在之后第一个 死亡时间+n*间隔
+func (p *ProxyIP) nextResurrectTime() int64 {
+	return nextAligned(p.deadSince(), graveyardInterval(), time.Now()).Unix()
+}
+
+// start 之后每隔 interval 一次，返回 now 之后的第一次，interval 必须大于 0
+func nextAligned(start time.Time, interval time.Duration, now time.Time) time.Time {
+	if now.Before(start) {
+		return start.Add(interval)
+	}
+	n := now.Sub(start)/interval + 1
+	return start.Add(n * interval)
+}
+
+// bury 放入墓地，移出所有索引，只保留复活检查的计划
+func (p *ProxyIP) bury() {
+	geoIndex.Remove(p.IP)
+	exitIndex.Remove(p.IP)
+	scores.Delete(p.IP)
+	p.NextCheckTime = p.nextResurrectTime()
+	plan.Set(p.IP, p.NextCheckTime)
+}
+
+// purgeIP 超过保留时间，从池子里彻底删除
+func purgeIP(dbPath string, p *ProxyIP) error {
+	gt.Info(p.IP, " 在墓地超过 ", graveyardKeep(), " 没有复活，从池子删除")
+	plan.Remove(p.IP)
+	stateIndex.Remove(p.IP)
+	return BadgerDeleteStruct(dbPath, p.IP)
+}
@@ -0,0 +1,42 @@
+package pool
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextAligned(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{"还没到死亡时间", start.Add(-time.Minute), start.Add(time.Hour)},
+		{"刚死亡", start, start.Add(time.Hour)},
+		{"第一个间隔内", start.Add(30 * time.Minute), start.Add(time.Hour)},
+		{"正好在间隔上取下一个", start.Add(2 * time.Hour), start.Add(3 * time.Hour)},
+		// 死亡很久也是直接算出来，不按间隔一个个加
+		{"一年以后", start.Add(365*24*time.Hour + time.Second), start.Add(365*24*time.Hour + time.Hour)},
+	}
+	for _, c := range cases {
+		if got := nextAligned(start, time.Hour, c.now); !got.Equal(c.want) {
+			t.Errorf("%s: %s, 期望 %s", c.name, got, c.want)
+		}
+	}
+}
+
+// 间隔配置成 0 或负数按最小值，不会死循环
+func TestNextResurrectTimeClamp(t *testing.T) {
+	for _, v := range []string{"0s", "-1h", "1ns"} {
+		useTestDir(t, "graveyardInterval: "+v+"\n")
+		if got := graveyardInterval(); got != minGraveyardInterval {
+			t.Fatalf("graveyardInterval %s = %s", v, got)
+		}
+		p := &ProxyIP{DeadTime: time.Now().Add(-72 * time.Hour).Unix()}
+		next := time.Unix(p.nextResurrectTime(), 0)
+		if wait := time.Until(next); wait <= 0 || wait > minGraveyardInterval {
+			t.Fatalf("graveyardInterval %s 下一次在 %s 后", v, wait)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package pool
+
+import (
+	"FreeProxyMange/conf"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+代理匿名度检测:
+通过代理请求判官接口，判官接口原样返回它看到的客户端IP和请求头，
+根据这些信息判断代理有没有泄露本机真实IP，有没有暴露自己是代理
+
+透明 transparent : 目标能看到本机真实IP
+普匿 anonymous   : 隐藏了真实IP，但请求头暴露了在使用代理
+高匿 elite       : 目标看不出在使用代理
+
+*/
+
+const (
+	AnonymityTransparent = "transparent"
+	AnonymityAnonymous   = "anonymous"
+	AnonymityElite       = "elite"
+)
+
+var anonymityLevel = map[string]int{
+	AnonymityTransparent: 1,
+	AnonymityAnonymous:   2,
+	AnonymityElite:       3,
+}
+
+// 代理会添加的请求头，只要出现就说明暴露了代理
+var judgeHeaders = []string{"X-Forwarded-For", "Via", "Forwarded", "X-Real-Ip"}
+
+// JudgeResp 判官接口的返回，兼容 httpbin.org/get 的格式
+type JudgeResp struct {
+	Origin  string            `json:"origin"`
+	Headers map[string]string `json:"headers"`
+}
+
+func JudgeUrl() string {
+	return conf.Str("judgeUrl", "http://httpbin.org/get")
+}
+
+// AnonymityAtLeast 匿名度 have 是否达到 want 的级别，want 为空表示不限制
+func AnonymityAtLeast(have, want string) bool {
+	if want == "" {
+		return true
+	}
+	return anonymityLevel[have] >= anonymityLevel[want]
+}
+
+func IsAnonymity(level string) bool {
+	_, ok := anonymityLevel[level]
+	return ok
+}
+
+// 本机真实IP，配置了 realIP 直接用，否则直连 realIPUrl(默认 judgeUrl) 获取，缓存10分钟
+// 判官部署在本机时直连看到的是 127.0.0.1，泄露公网IP的透明代理就检测不出来，
+// 这时要配置 realIP 或者用外网的 realIPUrl
+var (
+	realIP     string
+	realIPTime time.Time
+	realIPErr  error
+	realIPWait chan struct{} // 正在获取时不为 nil，获取完关闭
+	realIPLock sync.Mutex
+)
+
+func RealIP() (string, error) {
+	if ip := conf.Str("realIP", ""); ip != "" {
+		return ip, nil
+	}
+	realIPLock.Lock()
+	if realIP != "" && time.Since(realIPTime) < 10*time.Minute {
+		ip := realIP
+		realIPLock.Unlock()
+		return ip, nil
+	}
+	// 已经有人在获取，等它的结果，不重复请求
+	if wait := realIPWait; wait != nil {
+		realIPLock.Unlock()
+		<-wait
+		realIPLock.Lock()
+		defer realIPLock.Unlock()
+		if realIPErr != nil {
+			return "", realIPErr
+		}
+		return realIP, nil
+	}
+	wait := make(chan struct{})
+	realIPWait = wait
+	realIPLock.Unlock()
+
+	// 请求不在锁里做，慢的时候不会挡住拿缓存的检查
+	ip, err := fetchRealIP()
+	realIPLock.Lock()
+	defer realIPLock.Unlock()
+	if err == nil {
+		realIP, realIPTime = ip, time.Now()
+	}
+	realIPErr = err
+	realIPWait = nil
+	close(wait)
+	return ip, err
+}
+
+func fetchRealIP() (string, error) {
+	ctx, err := gt.Get(conf.Str("realIPUrl", JudgeUrl()), gt.ReqTimeOut(10))
+	if err != nil {
+		return "", fmt.Errorf("获取本机真实IP失败: %w", err)
+	}
+	resp, err := parseJudge(ctx)
+	if err != nil {
+		return "", fmt.Errorf("获取本机真实IP失败: %w", err)
+	}
+	ips := resp.OriginIPs()
+	if len(ips) == 0 {
+		return "", errors.New("获取本机真实IP失败: 判官接口没有返回origin")
+	}
+	if ip := net.ParseIP(ips[0]); ip != nil && (ip.IsLoopback() || ip.IsPrivate()) {
+		gt.Error("本机真实IP是 ", ips[0], "，检测不出泄露公网IP的透明代理，请配置 realIP 或者外网的 realIPUrl")
+	}
+	return ips[0], nil
+}
+
+// Judge 通过代理请求判官接口，返回代理的匿名度
+func (p *ProxyIP) Judge(ctx context.Context) (string, error) {
+	myIP, err := RealIP()
+	if err != nil {
+		return "", err
+	}
+	c, err := p.get(ctx, JudgeUrl(), 10*time.Second)
+	if err != nil {
+		return "", err
+	}
+	resp, err := parseJudge(c)
+	if err != nil {
+		return "", err
+	}
+	level := resp.Anonymity(myIP)
+	// 经过多层转发时最后一个才是直接连到判官的出口IP
+	if ips := resp.OriginIPs(); len(ips) > 0 {
+		p.ExitIP = ips[len(ips)-1]
+	}
+	gt.Info(p.IP, " 匿名度 = ", level, " 出口IP = ", p.ExitIP)
+	return level, nil
+}
+
+func parseJudge(ctx *gt.Context) (*JudgeResp, error) {
+	if ctx.StateCode != 200 {
+		return nil, fmt.Errorf("判官接口返回状态码 %d", ctx.StateCode)
+	}
+	resp := &JudgeResp{}
+	if err := json.Unmarshal(ctx.RespBody, resp); err != nil {
+		return nil, fmt.Errorf("判官接口返回解析失败: %w", err)
+	}
+	return resp, nil
+}
+
+// OriginIPs 判官看到的客户端IP，经过多层转发时 httpbin 会返回 "a, b"
+func (j *JudgeResp) OriginIPs() []string {
+	ips := make([]string, 0)
+	for _, v := range strings.Split(j.Origin, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			ips = append(ips, v)
+		}
+	}
+	return ips
+}
+
+func (j *JudgeResp) Header(key string) string {
+	for k, v := range j.Headers {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+// Anonymity 根据判官返回判断匿名度，myIP 是本机真实IP
+func (j *JudgeResp) Anonymity(myIP string) string {
+	for _, v := range j.OriginIPs() {
+		if v == myIP {
+			return AnonymityTransparent
+		}
+	}
+	leak := false
+	for _, k := range judgeHeaders {
+		v := j.Header(k)
+		if v == "" {
+			continue
+		}
+		if strings.Contains(v, myIP) {
+			return AnonymityTransparent
+		}
+		leak = true
+	}
+	if leak {
+		return AnonymityAnonymous
+	}
+	return AnonymityElite
+}
@@ -0,0 +1,76 @@
+package pool
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func resetRealIP(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		realIPLock.Lock()
+		realIP, realIPTime, realIPErr = "", time.Time{}, nil
+		realIPLock.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestRealIPConfigured(t *testing.T) {
+	useTestDir(t, "realIP: 9.9.9.9\nrealIPUrl: http://127.0.0.1:1/get\n")
+	resetRealIP(t)
+	ip, err := RealIP()
+	if err != nil || ip != "9.9.9.9" {
+		t.Fatalf("RealIP = %s %v", ip, err)
+	}
+	// 配置了公网IP，判官在本机也能看出泄露公网IP的透明代理
+	resp := &JudgeResp{Origin: "127.0.0.1", Headers: map[string]string{"X-Forwarded-For": "9.9.9.9"}}
+	if level := resp.Anonymity(ip); level != AnonymityTransparent {
+		t.Fatalf("匿名度 = %s", level)
+	}
+}
+
+// 同时有很多检查要真实IP时只请求一次，请求期间不占着锁
+func TestRealIPFetchOnce(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		_, _ = w.Write([]byte(`{"origin":"5.6.7.8","headers":{}}`))
+	}))
+	defer echo.Close()
+	useTestDir(t, "realIPUrl: "+echo.URL+"/get\n")
+	resetRealIP(t)
+
+	var wg sync.WaitGroup
+	ips := make([]string, 10)
+	for i := range ips {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ips[i], _ = RealIP()
+		}(i)
+	}
+	// 请求还没返回时锁是空闲的
+	time.Sleep(100 * time.Millisecond)
+	if !realIPLock.TryLock() {
+		t.Fatal("获取真实IP时一直占着锁")
+	}
+	realIPLock.Unlock()
+	close(release)
+	wg.Wait()
+
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("请求了 %d 次", n)
+	}
+	for _, ip := range ips {
+		if ip != "5.6.7.8" {
+			t.Fatalf("RealIP = %q", ip)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package pool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+分配记录:
+target 分配出去的ip的租约存在 ./lease，和池子一起关闭，重启后 target 用它恢复已分配的ip
+不能放在 ./data 下面，AllDBPath 会把 ./data 的子目录都当成池子的表
+
+*/
+
+const LeaseDBPath = "./lease"
+
+// Lease 一次分配的租约
+type Lease struct {
+	ID       string `json:"id"`
+	IP       string `json:"ip"`
+	Holder   string `json:"holder"`   // 使用方
+	LeasedAt int64  `json:"leasedAt"` // 分配时间
+	ExpireAt int64  `json:"expireAt"` // 到期时间，到期后自动归还
+}
+
+// SaveLease 新增或更新租约
+func SaveLease(l *Lease) error {
+	if l == nil || l.IP == "" {
+		return errors.New("租约的ip不能为空")
+	}
+	valueBytes, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("租约序列化失败: %w", err)
+	}
+	db, err := openDB(LeaseDBPath)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(l.IP), valueBytes)
+	})
+}
+
+// DeleteLease 删除租约，不存在不报错
+func DeleteLease(ip string) error {
+	db, err := openDB(LeaseDBPath)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(ip))
+	})
+}
+
+// AllLeases 读取所有租约
+func AllLeases() ([]*Lease, error) {
+	db, err := openDB(LeaseDBPath)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Lease, 0)
+	err = db.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			valueBytes, err := iter.Item().ValueCopy(nil)
+			if err != nil {
+				return fmt.Errorf("拷贝值失败: %w", err)
+			}
+			var l Lease
+			if err := json.Unmarshal(valueBytes, &l); err != nil {
+				gt.Error("租约反序列化失败: ", string(iter.Item().Key()), err)
+				continue
+			}
+			list = append(list, &l)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("读取租约失败: %w", err)
+	}
+	return list, nil
+}
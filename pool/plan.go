@@ -0,0 +1,185 @@
+package pool
+
+import (
+	"FreeProxyMange/conf"
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+自适应检查计划:
+每个ip检查完后按检查结果算出下一次检查时间 NextCheckTime，存到池子里
+1. 新入池的ip前 checkNewCount 次每 checkNewInterval 检查一次，尽快确认能不能用
+2. 稳定可用的ip从 checkBaseInterval 开始，每连续成功 10 次间隔翻倍，最长 checkMaxInterval
+3. 检查失败的ip从 checkFailInterval 或失败分类配置的 backoff 开始按连续失败次数指数退避，最长 checkMaxInterval，
+   同一类连续失败到 failPolicy 配置的次数后放入墓地，见 failure.go graveyard.go
+启动时从池子恢复计划，已经过期的ip按检查速率打散，避免重启后所有ip同时检查
+
+*/
+
+type planItem struct {
+	ip string
+	at int64
+}
+
+type planHeap []planItem
+
+func (h planHeap) Len() int            { return len(h) }
+func (h planHeap) Less(i, j int) bool  { return h[i].at < h[j].at }
+func (h planHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *planHeap) Push(x interface{}) { *h = append(*h, x.(planItem)) }
+func (h *planHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// 检查计划，堆里同一个ip可能有多条，以 next 里的时间为准，其余的出堆时丢弃
+type checkPlan struct {
+	lock sync.Mutex
+	heap planHeap
+	next map[string]int64
+}
+
+var plan = &checkPlan{next: make(map[string]int64)}
+
+// Set 设置ip下一次检查的时间
+func (pl *checkPlan) Set(ip string, at int64) {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	pl.next[ip] = at
+	heap.Push(&pl.heap, planItem{ip: ip, at: at})
+}
+
+func (pl *checkPlan) Remove(ip string) {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	delete(pl.next, ip)
+}
+
+// Due 取出所有到了检查时间的ip
+func (pl *checkPlan) Due(now int64) []string {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	ips := make([]string, 0)
+	for pl.heap.Len() > 0 && pl.heap[0].at <= now {
+		item := heap.Pop(&pl.heap).(planItem)
+		if at, ok := pl.next[item.ip]; !ok || at != item.at {
+			continue
+		}
+		delete(pl.next, item.ip)
+		ips = append(ips, item.ip)
+	}
+	return ips
+}
+
+func (pl *checkPlan) Len() int {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	return len(pl.next)
+}
+
+// CheckSoon 马上安排检查，使用方反馈代理有问题时用
+func CheckSoon(ip string) {
+	plan.Set(ip, time.Now().Unix())
+}
+
+// loadPlan 从池子恢复检查计划，顺便恢复状态、地理信息、出口IP索引和分数，墓地里的ip按复活检查的时间计划
+func loadPlan() {
+	now := time.Now().Unix()
+	overdue := make([]string, 0)
+	for _, p := range AllDBPath() {
+		list, err := BadgerGetAllStruct(p)
+		if err != nil {
+			gt.Error(err)
+			continue
+		}
+		for _, ip := range list {
+			if ip.State == "" {
+				// 旧数据补上状态
+				if err := ip.Transition(ip.inferState(), "恢复旧数据"); err != nil {
+					gt.Error(err)
+				}
+				if err := BadgerUpsertStruct(p, ip.IP, ip); err != nil {
+					gt.Error(err)
+				}
+			}
+			if ip.State == StateDead {
+				if ip.graveyardExpired() {
+					if err := purgeIP(p, ip); err != nil {
+						gt.Error(err)
+					}
+					continue
+				}
+				stateIndex.Set(ip.IP, ip.State)
+				plan.Set(ip.IP, ip.nextResurrectTime())
+				continue
+			}
+			stateIndex.Set(ip.IP, ip.State)
+			geoIndex.Update(ip)
+			exitIndex.Update(ip)
+			scores.Store(ip.IP, ip.Score)
+			if ip.NextCheckTime > now {
+				plan.Set(ip.IP, ip.NextCheckTime)
+			} else {
+				overdue = append(overdue, ip.IP)
+			}
+		}
+	}
+
+	// 过期的ip按检查速率均匀打散到接下来的时间里
+	spread := int64(len(overdue) / Checker.rate)
+	for _, ip := range overdue {
+		at := now
+		if spread > 0 {
+			at += rand.Int63n(spread + 1)
+		}
+		plan.Set(ip, at)
+	}
+	gt.Info("恢复检查计划 ", plan.Len(), " 个，其中已过期打散 ", len(overdue), " 个")
+	gt.Info("池子状态 ", StateCounts())
+	setReady()
+}
+
+// nextCheckInterval 根据检查结果计算到下一次检查的间隔
+func (p *ProxyIP) nextCheckInterval() time.Duration {
+	maxInterval := conf.Duration("checkMaxInterval", 30*time.Minute)
+	var d time.Duration
+	switch {
+	case p.State == StateQuarantined:
+		// 隔离的ip低频检查
+		d = maxInterval
+	case p.ConsecutiveFail > 0:
+		base := GetFailPolicy(p.LastFailClass).Backoff
+		if base <= 0 {
+			base = conf.Duration("checkFailInterval", time.Minute)
+		}
+		d = backoff(base, p.ConsecutiveFail-1, maxInterval)
+	case p.CheckNum < conf.Int("checkNewCount", 5):
+		d = conf.Duration("checkNewInterval", time.Minute)
+	default:
+		d = backoff(conf.Duration("checkBaseInterval", 2*time.Minute), p.ConsecutiveSuccess/10, maxInterval)
+	}
+	// 加 ±10% 的抖动，避免同一批入池的ip一直同时检查
+	jitter := time.Duration(rand.Int63n(int64(d)/5+1)) - d/10
+	return d + jitter
+}
+
+// base 翻倍 n 次，不超过 max
+func backoff(base time.Duration, n int, max time.Duration) time.Duration {
+	d := base
+	for i := 0; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
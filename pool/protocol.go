@@ -0,0 +1,358 @@
+package pool
+
+import (
+	"FreeProxyMange/conf"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+代理协议探测:
+新代理入池后依次探测 http 转发、CONNECT 隧道、SOCKS4/4a、SOCKS5，记录支持的全部协议，
+之后的检查和分配都按探测出的协议使用对应的拨号方式
+
+*/
+
+const (
+	ProtocolHttp    = "http"    // 普通 http 转发
+	ProtocolHttps   = "https"   // CONNECT 隧道
+	ProtocolSocks4  = "socks4"  // 本地解析域名
+	ProtocolSocks4a = "socks4a" // 代理解析域名
+	ProtocolSocks5  = "socks5"
+)
+
+// 同时支持多种协议时按这个顺序选择使用哪种
+var protocolPriority = []string{ProtocolHttps, ProtocolHttp, ProtocolSocks5, ProtocolSocks4a, ProtocolSocks4}
+
+// ParseProxy 解析代理地址，支持 ip:port 和 scheme://user:pass@ip:port
+// scheme 支持 http https socks4 socks4a socks5 socks5h，带了 scheme 就直接作为代理协议不再探测
+func ParseProxy(raw string) (*ProxyIP, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, errors.New("代理地址不能为空")
+	}
+	hasScheme := strings.Contains(raw, "://")
+	if !hasScheme {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("代理地址错误: %w", err)
+	}
+	if _, _, err := splitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("代理地址错误: %w", err)
+	}
+
+	p := &ProxyIP{IP: u.Host}
+	protocol := ""
+	switch u.Scheme {
+	case "http":
+		protocol = ProtocolHttp
+	case "https":
+		protocol = ProtocolHttps
+	case "socks5", "socks5h":
+		protocol = ProtocolSocks5
+	case "socks4":
+		protocol = ProtocolSocks4
+	case "socks4a":
+		protocol = ProtocolSocks4a
+	default:
+		return nil, fmt.Errorf("不支持的代理协议: %s", u.Scheme)
+	}
+	if hasScheme {
+		p.Protocols = []string{protocol}
+		p.Type = protocolType(protocol)
+	}
+	if u.User != nil {
+		p.User = u.User.Username()
+		p.Pass, _ = u.User.Password()
+	}
+	return p, nil
+}
+
+// socks 代理是否把域名交给代理解析，默认 true，避免本地 DNS 泄露和被污染
+func socksRemoteDNS() bool {
+	return conf.Bool("socksRemoteDNS", true)
+}
+
+// 探测 CONNECT 和 socks 时连接的目标
+func probeHost() string {
+	return conf.Str("probeHost", "httpbin.org")
+}
+
+// Addr 代理的 host:port，去掉协议头
+func (p *ProxyIP) Addr() string {
+	if i := strings.Index(p.IP, "://"); i >= 0 {
+		return p.IP[i+3:]
+	}
+	return p.IP
+}
+
+func (p *ProxyIP) HasProtocol(protocol string) bool {
+	for _, v := range p.Protocols {
+		if v == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+func IsProtocol(protocol string) bool {
+	for _, v := range protocolPriority {
+		if v == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// Supports 是否支持该协议，没有探测过协议的按代理类型判断
+func (p *ProxyIP) Supports(protocol string) bool {
+	if len(p.Protocols) == 0 {
+		return protocolType(protocol) == p.Type
+	}
+	return p.HasProtocol(protocol)
+}
+
+// ProxyUrlFor 按指定协议使用时的代理地址，https 是 http 代理的 CONNECT，地址和 http 一样
+func (p *ProxyIP) ProxyUrlFor(protocol string) string {
+	if protocol == "" {
+		return p.ProxyUrl()
+	}
+	v := *p
+	v.Type = protocolType(protocol)
+	return v.ProxyUrl()
+}
+
+// ProxyUrl 按代理类型拼接的代理地址，带账号密码，可以直接给客户端使用
+// socks 使用远程解析域名时 socks5 返回 socks5h，socks4 支持 4a 时返回 socks4a
+func (p *ProxyIP) ProxyUrl() string {
+	return p.proxyURL().String()
+}
+
+// RedactedUrl 密码替换成 xxxxx 的代理地址，写日志和不该暴露账号的返回用这个
+func (p *ProxyIP) RedactedUrl() string {
+	return p.proxyURL().Redacted()
+}
+
+func (p *ProxyIP) proxyURL() *url.URL {
+	u := &url.URL{Scheme: "http", Host: p.Addr()}
+	switch p.Type {
+	case ProtocolSocks5:
+		u.Scheme = "socks5"
+		if socksRemoteDNS() {
+			u.Scheme = "socks5h"
+		}
+	case ProtocolSocks4:
+		u.Scheme = "socks4"
+		if socksRemoteDNS() && p.HasProtocol(ProtocolSocks4a) {
+			u.Scheme = "socks4a"
+		}
+	}
+	if p.User != "" {
+		u.User = url.UserPassword(p.User, p.Pass)
+	}
+	return u
+}
+
+// Client 按代理类型创建 http.Client，所有经过代理的请求都用它
+func (p *ProxyIP) Client(timeout time.Duration) *http.Client {
+	transport := &http.Transport{
+		DisableKeepAlives:   true,
+		TLSHandshakeTimeout: timeout,
+	}
+	switch p.Type {
+	case ProtocolSocks5, ProtocolSocks4:
+		transport.DialContext = p.dialContext(timeout)
+	default:
+		proxy, err := url.Parse(p.ProxyUrl())
+		if err != nil {
+			gt.Error("设置代理失败:", err)
+		} else {
+			transport.Proxy = http.ProxyURL(proxy)
+		}
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+}
+
+// 通过 socks 代理建立到 addr 的连接
+func (p *ProxyIP) dialContext(timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	protocol := p.Type
+	if protocol == ProtocolSocks4 && socksRemoteDNS() && p.HasProtocol(ProtocolSocks4a) {
+		protocol = ProtocolSocks4a
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return p.dialSocks(ctx, protocol, addr, timeout)
+	}
+}
+
+func (p *ProxyIP) dialSocks(ctx context.Context, protocol, addr string, timeout time.Duration) (net.Conn, error) {
+	d := &net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", p.Addr())
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(timeout)
+	}
+	_ = conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	switch protocol {
+	case ProtocolSocks5:
+		err = socks5Connect(conn, addr, p.User, p.Pass, socksRemoteDNS())
+	case ProtocolSocks4a:
+		err = socks4Connect(conn, addr, p.User, true)
+	case ProtocolSocks4:
+		err = socks4Connect(conn, addr, p.User, false)
+	default:
+		err = fmt.Errorf("不支持的 socks 协议 %s", protocol)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// DetectProtocols 探测代理支持的全部协议，并设置 Type
+func (p *ProxyIP) DetectProtocols(ctx context.Context) []string {
+	timeout := 10 * time.Second
+	probes := map[string]func() error{
+		ProtocolHttp:    func() error { return p.probeHttp(ctx, timeout) },
+		ProtocolHttps:   func() error { return p.probeConnect(ctx, timeout) },
+		ProtocolSocks4:  func() error { return p.probeSocks(ctx, ProtocolSocks4, timeout) },
+		ProtocolSocks4a: func() error { return p.probeSocks(ctx, ProtocolSocks4a, timeout) },
+		ProtocolSocks5:  func() error { return p.probeSocks(ctx, ProtocolSocks5, timeout) },
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	supported := make(map[string]bool)
+	for protocol, probe := range probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := probe(); err != nil {
+				return
+			}
+			lock.Lock()
+			supported[protocol] = true
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	p.Protocols = make([]string, 0, len(supported))
+	p.Type = ""
+	for _, protocol := range protocolPriority {
+		if !supported[protocol] {
+			continue
+		}
+		p.Protocols = append(p.Protocols, protocol)
+		if p.Type == "" {
+			p.Type = protocolType(protocol)
+		}
+	}
+	gt.Info(p.IP, " 支持的协议 = ", p.Protocols)
+	return p.Protocols
+}
+
+// 协议对应的代理类型，http 和 CONNECT 都是 http 代理，socks4a 是 socks4 的扩展
+func protocolType(protocol string) string {
+	switch protocol {
+	case ProtocolHttps:
+		return ProtocolHttp
+	case ProtocolSocks4a:
+		return ProtocolSocks4
+	}
+	return protocol
+}
+
+// 通过 http 转发请求判官接口
+func (p *ProxyIP) probeHttp(ctx context.Context, timeout time.Duration) error {
+	probe := &ProxyIP{IP: p.IP, Type: ProtocolHttp, User: p.User, Pass: p.Pass}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, JudgeUrl(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := probe.Client(timeout).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http 转发返回状态码 %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// 发送 CONNECT 建立隧道
+func (p *ProxyIP) probeConnect(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	d := &net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", p.Addr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	// ctx 取消时关闭连接中断读写
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	target := net.JoinHostPort(probeHost(), "443")
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if p.User != "" {
+		req.SetBasicAuth(p.User, p.Pass)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT 返回状态码 %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// socks 握手并连接到探测目标
+func (p *ProxyIP) probeSocks(ctx context.Context, protocol string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := p.dialSocks(ctx, protocol, net.JoinHostPort(probeHost(), "80"), timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
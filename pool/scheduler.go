@@ -0,0 +1,250 @@
+package pool
+
+import (
+	"FreeProxyMange/conf"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+检查调度器:
+所有代理检查都提交到同一个队列，由固定数量的 worker 并发执行
+1. checkWorkers     worker 数量
+2. checkRate        全局每秒最多开始多少个检查
+3. checkSubnetLimit 同一个 /24 网段同时最多检查几个，避免同网段代理一起被目标限流
+4. checkQueueSize   队列长度，队列满了提交会失败，checkRetryDelay 秒后重新计划
+
+*/
+
+// 提交失败、被丢掉或者读不到记录的检查，隔多少秒重新计划
+const checkRetryDelay = 10
+
+// Checker 全局检查调度器，pool.Run 时创建
+var Checker *Scheduler
+
+type Scheduler struct {
+	workers     int
+	rate        int
+	subnetLimit int
+	queue       chan string
+
+	// 已在队列里或正在检查的ip，避免重复提交
+	pending sync.Map
+
+	subnetLock sync.Mutex
+	subnet     map[string]int
+
+	inFlight  int64
+	checked   int64
+	succeeded int64
+	failed    int64
+
+	// 最近60秒每秒完成的检查数，用于计算吞吐
+	statLock  sync.Mutex
+	statSec   [60]int64
+	statCount [60]int64
+}
+
+// SchedulerMetrics 调度器运行指标
+type SchedulerMetrics struct {
+	Workers     int   `json:"workers"`
+	Rate        int   `json:"rate"`        // 每秒最多开始的检查数
+	SubnetLimit int   `json:"subnetLimit"` // 每个 /24 网段最多同时检查数
+	QueueDepth  int   `json:"queueDepth"`  // 队列中等待检查的数量
+	QueueSize   int   `json:"queueSize"`
+	InFlight    int64 `json:"inFlight"`  // 正在检查的数量
+	Checked     int64 `json:"checked"`   // 启动以来完成的检查数
+	Succeeded   int64 `json:"succeeded"` // 其中检查通过的
+	Failed      int64 `json:"failed"`    // 其中检查失败的
+	PerMinute   int64 `json:"perMinute"` // 最近一分钟完成的检查数
+}
+
+func NewScheduler() *Scheduler {
+	s := &Scheduler{
+		workers:     conf.Int("checkWorkers", 32),
+		rate:        conf.Int("checkRate", 20),
+		subnetLimit: conf.Int("checkSubnetLimit", 2),
+		queue:       make(chan string, conf.Int("checkQueueSize", 10000)),
+		subnet:      make(map[string]int),
+	}
+	if s.workers < 1 {
+		s.workers = 1
+	}
+	if s.rate < 1 {
+		s.rate = 1
+	}
+	if s.subnetLimit < 1 {
+		s.subnetLimit = 1
+	}
+	return s
+}
+
+// Submit 提交一个待检查的ip，已在队列里或队列满了返回 false
+func (s *Scheduler) Submit(ip string) bool {
+	if _, loaded := s.pending.LoadOrStore(ip, struct{}{}); loaded {
+		return false
+	}
+	select {
+	case s.queue <- ip:
+		return true
+	default:
+		s.pending.Delete(ip)
+		return false
+	}
+}
+
+// requeue 放回队尾，队列满了就丢掉，计划已经被 Due 取走了，要重新计划
+func (s *Scheduler) requeue(ip string) {
+	select {
+	case s.queue <- ip:
+	default:
+		plan.Set(ip, time.Now().Unix()+checkRetryDelay)
+		s.pending.Delete(ip)
+	}
+}
+
+// Run 启动 worker 并阻塞，ctx 取消后正在进行的检查会被立即中断，等所有 worker 退出后返回
+func (s *Scheduler) Run(ctx context.Context) {
+	gt.Infof("检查调度器启动 worker:%d 每秒:%d 网段并发:%d", s.workers, s.rate, s.subnetLimit)
+	limiter := time.NewTicker(time.Second / time.Duration(s.rate))
+	defer limiter.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.worker(ctx, limiter.C)
+		}()
+	}
+	wg.Wait()
+	gt.Info("检查调度器已停止")
+}
+
+func (s *Scheduler) worker(ctx context.Context, limiter <-chan time.Time) {
+	for {
+		var ip string
+		select {
+		case <-ctx.Done():
+			return
+		case ip = <-s.queue:
+		}
+
+		subnet := Subnet(ip)
+		if !s.acquireSubnet(subnet) {
+			// 该网段已达并发上限，放回队尾
+			s.requeue(ip)
+			// 避免队列里全是同一网段时空转
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			s.releaseSubnet(subnet)
+			return
+		case <-limiter:
+		}
+
+		atomic.AddInt64(&s.inFlight, 1)
+		err := checkOne(ctx, ip)
+		atomic.AddInt64(&s.inFlight, -1)
+		s.releaseSubnet(subnet)
+		s.pending.Delete(ip)
+		if ctx.Err() != nil {
+			return
+		}
+		s.record(err == nil)
+	}
+}
+
+func (s *Scheduler) acquireSubnet(subnet string) bool {
+	s.subnetLock.Lock()
+	defer s.subnetLock.Unlock()
+	if s.subnet[subnet] >= s.subnetLimit {
+		return false
+	}
+	s.subnet[subnet]++
+	return true
+}
+
+func (s *Scheduler) releaseSubnet(subnet string) {
+	s.subnetLock.Lock()
+	defer s.subnetLock.Unlock()
+	s.subnet[subnet]--
+	if s.subnet[subnet] <= 0 {
+		delete(s.subnet, subnet)
+	}
+}
+
+func (s *Scheduler) record(ok bool) {
+	atomic.AddInt64(&s.checked, 1)
+	if ok {
+		atomic.AddInt64(&s.succeeded, 1)
+	} else {
+		atomic.AddInt64(&s.failed, 1)
+	}
+	now := time.Now().Unix()
+	i := now % 60
+	s.statLock.Lock()
+	if s.statSec[i] != now {
+		s.statSec[i] = now
+		s.statCount[i] = 0
+	}
+	s.statCount[i]++
+	s.statLock.Unlock()
+}
+
+func (s *Scheduler) Metrics() SchedulerMetrics {
+	now := time.Now().Unix()
+	var perMinute int64
+	s.statLock.Lock()
+	for i := range s.statSec {
+		if now-s.statSec[i] < 60 {
+			perMinute += s.statCount[i]
+		}
+	}
+	s.statLock.Unlock()
+	return SchedulerMetrics{
+		Workers:     s.workers,
+		Rate:        s.rate,
+		SubnetLimit: s.subnetLimit,
+		QueueDepth:  len(s.queue),
+		QueueSize:   cap(s.queue),
+		InFlight:    atomic.LoadInt64(&s.inFlight),
+		Checked:     atomic.LoadInt64(&s.checked),
+		Succeeded:   atomic.LoadInt64(&s.succeeded),
+		Failed:      atomic.LoadInt64(&s.failed),
+		PerMinute:   perMinute,
+	}
+}
+
+// Subnet ip所在的网段，IPv4 取 /24，IPv6 取 /64，域名原样返回
+func Subnet(ip string) string {
+	host := ip
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	addr := net.ParseIP(host)
+	if addr == nil {
+		return host
+	}
+	if ip4 := addr.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return addr.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
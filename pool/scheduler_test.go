@@ -0,0 +1,30 @@
+package pool
+
+import (
+	"testing"
+	"time"
+)
+
+// 队列满了放不回去的ip要重新计划，不能丢掉
+func TestRequeueFullQueue(t *testing.T) {
+	s := &Scheduler{queue: make(chan string, 1), subnet: make(map[string]int)}
+	if !s.Submit("1.1.1.1:80") {
+		t.Fatal("空队列应该能提交")
+	}
+	s.pending.Store("1.1.1.2:80", struct{}{})
+	s.requeue("1.1.1.2:80")
+	t.Cleanup(func() { plan.Remove("1.1.1.2:80") })
+
+	if _, ok := s.pending.Load("1.1.1.2:80"); ok {
+		t.Fatal("丢掉的ip还留在 pending 里，之后提交不进来")
+	}
+	plan.lock.Lock()
+	at, ok := plan.next["1.1.1.2:80"]
+	plan.lock.Unlock()
+	if !ok {
+		t.Fatal("丢掉的ip没有重新计划")
+	}
+	if now := time.Now().Unix(); at < now || at > now+checkRetryDelay {
+		t.Fatalf("重新计划时间 = %d", at)
+	}
+}
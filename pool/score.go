@@ -0,0 +1,351 @@
+package pool
+
+import (
+	"FreeProxyMange/conf"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+代理质量分:
+每次检查后按公式重新计算 Score，列表接口按分数从高到低排序，分配时优先给分数高的
+公式在配置文件 scoreFormula 里配置，支持 + - * / 括号 和 min(a,b) max(a,b) log(x) sqrt(x)，可用的变量:
+
+p50         最近检查成功的响应时间中位数 ms
+p90         最近检查成功的响应时间 90 分位 ms
+success     最近检查的成功率 0~1
+consecFail  连续失败次数
+consecOK    连续成功次数
+ageHours    入池多少小时
+anonymity   匿名度 透明 0 普匿 0.5 高匿 1
+site        配置的网站里验证通过的比例 0~1，没配置网站为 1
+checks      累计检查成功次数
+kbps        最后一次带宽测试的下载速度，没测过为 0
+
+*/
+
+const defaultScoreFormula = "100*success + 20*site + 10*anonymity + min(ageHours, 72)/6 - p90/200 - 15*consecFail"
+
+var scoreVars = []string{"p50", "p90", "success", "consecFail", "consecOK", "ageHours", "anonymity", "site", "checks", "kbps"}
+
+var (
+	scoreExpr     scoreNode
+	scoreExprOnce sync.Once
+)
+
+func scoreFormula() scoreNode {
+	scoreExprOnce.Do(func() {
+		formula := conf.Str("scoreFormula", defaultScoreFormula)
+		expr, err := ParseScoreFormula(formula)
+		if err != nil {
+			gt.Error("评分公式错误，使用默认公式: ", err)
+			expr, _ = ParseScoreFormula(defaultScoreFormula)
+		}
+		scoreExpr = expr
+	})
+	return scoreExpr
+}
+
+// ScoreVars 计算评分公式用到的变量
+func (p *ProxyIP) ScoreVars() map[string]float64 {
+	okMs := make([]float64, 0, len(p.History))
+	okNum := 0
+	for _, h := range p.History {
+		if h.OK {
+			okNum++
+			okMs = append(okMs, float64(h.Ms))
+		}
+	}
+	sort.Float64s(okMs)
+
+	success := 0.0
+	if len(p.History) > 0 {
+		success = float64(okNum) / float64(len(p.History))
+	}
+
+	anonymity := 0.0
+	switch p.Anonymity {
+	case AnonymityAnonymous:
+		anonymity = 0.5
+	case AnonymityElite:
+		anonymity = 1
+	}
+
+	site := 1.0
+	if profiles := SiteProfiles(); len(profiles) > 0 {
+		passed := 0
+		for _, s := range profiles {
+			if p.SiteOK(s.Name) {
+				passed++
+			}
+		}
+		site = float64(passed) / float64(len(profiles))
+	}
+
+	ageHours := 0.0
+	if p.AddTime > 0 {
+		ageHours = time.Since(time.Unix(p.AddTime, 0)).Hours()
+	}
+
+	return map[string]float64{
+		"p50":        percentile(okMs, 0.5),
+		"p90":        percentile(okMs, 0.9),
+		"success":    success,
+		"consecFail": float64(p.ConsecutiveFail),
+		"consecOK":   float64(p.ConsecutiveSuccess),
+		"ageHours":   ageHours,
+		"anonymity":  anonymity,
+		"site":       site,
+		"checks":     float64(p.CheckNum),
+		"kbps":       float64(p.Kbps),
+	}
+}
+
+// UpdateScore 重新计算分数并更新内存里的分数索引
+func (p *ProxyIP) UpdateScore() float64 {
+	score := scoreFormula().eval(p.ScoreVars())
+	if math.IsNaN(score) || math.IsInf(score, 0) {
+		score = 0
+	}
+	p.Score = math.Round(score*100) / 100
+	scores.Store(p.IP, p.Score)
+	return p.Score
+}
+
+// 所有ip的分数，列表排序用，不用每次读库
+var scores sync.Map
+
+func GetScore(ip string) float64 {
+	if v, ok := scores.Load(ip); ok {
+		return v.(float64)
+	}
+	return 0
+}
+
+// SortByScore 按分数从高到低排序
+func SortByScore(ips []string) {
+	sort.SliceStable(ips, func(i, j int) bool {
+		return GetScore(ips[i]) > GetScore(ips[j])
+	})
+}
+
+// 已排序的数据取分位数，没有数据返回 0
+func percentile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// ================ 评分公式解析 ================
+
+type scoreNode func(vars map[string]float64) float64
+
+func (n scoreNode) eval(vars map[string]float64) float64 {
+	return n(vars)
+}
+
+type scoreParser struct {
+	src string
+	pos int
+}
+
+// ParseScoreFormula 解析评分公式，变量名不存在会报错
+func ParseScoreFormula(formula string) (scoreNode, error) {
+	p := &scoreParser{src: formula}
+	node, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return nil, fmt.Errorf("公式第 %d 个字符无法解析: %q", p.pos+1, p.src[p.pos:])
+	}
+	return node, nil
+}
+
+func (p *scoreParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *scoreParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+// expr = term { (+|-) term }
+func (p *scoreParser) expr() (scoreNode, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == '+' {
+			left = func(v map[string]float64) float64 { return l(v) + right(v) }
+		} else {
+			left = func(v map[string]float64) float64 { return l(v) - right(v) }
+		}
+	}
+}
+
+// term = unary { (*|/) unary }
+func (p *scoreParser) term() (scoreNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == '*' {
+			left = func(v map[string]float64) float64 { return l(v) * right(v) }
+		} else {
+			left = func(v map[string]float64) float64 {
+				d := right(v)
+				if d == 0 {
+					return 0
+				}
+				return l(v) / d
+			}
+		}
+	}
+}
+
+// unary = -unary | primary
+func (p *scoreParser) unary() (scoreNode, error) {
+	if p.peek() == '-' {
+		p.pos++
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(v map[string]float64) float64 { return -n(v) }, nil
+	}
+	return p.primary()
+}
+
+// primary = number | 变量 | 函数(参数, ...) | ( expr )
+func (p *scoreParser) primary() (scoreNode, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, errors.New("公式不完整")
+
+	case c == '(':
+		p.pos++
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("公式第 %d 个字符缺少 )", p.pos+1)
+		}
+		p.pos++
+		return n, nil
+
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		f, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("公式第 %d 个字符数字错误: %s", start+1, p.src[start:p.pos])
+		}
+		return func(map[string]float64) float64 { return f }, nil
+
+	case unicode.IsLetter(rune(c)):
+		start := p.pos
+		for p.pos < len(p.src) && (unicode.IsLetter(rune(p.src[p.pos])) || unicode.IsDigit(rune(p.src[p.pos]))) {
+			p.pos++
+		}
+		name := p.src[start:p.pos]
+		if p.peek() == '(' {
+			return p.call(name)
+		}
+		for _, v := range scoreVars {
+			if v == name {
+				return func(vars map[string]float64) float64 { return vars[name] }, nil
+			}
+		}
+		return nil, fmt.Errorf("未知的变量: %s", name)
+	}
+	return nil, fmt.Errorf("公式第 %d 个字符无法解析: %q", p.pos+1, string(c))
+}
+
+func (p *scoreParser) call(name string) (scoreNode, error) {
+	p.pos++ // (
+	args := make([]scoreNode, 0, 2)
+	if p.peek() != ')' {
+		for {
+			arg, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.peek() != ',' {
+				break
+			}
+			p.pos++
+		}
+	}
+	if p.peek() != ')' {
+		return nil, fmt.Errorf("函数 %s 缺少 )", name)
+	}
+	p.pos++
+
+	want := map[string]int{"min": 2, "max": 2, "log": 1, "sqrt": 1}
+	n, ok := want[name]
+	if !ok {
+		return nil, fmt.Errorf("未知的函数: %s", name)
+	}
+	if len(args) != n {
+		return nil, fmt.Errorf("函数 %s 需要 %d 个参数", name, n)
+	}
+	switch name {
+	case "min":
+		return func(v map[string]float64) float64 { return math.Min(args[0](v), args[1](v)) }, nil
+	case "max":
+		return func(v map[string]float64) float64 { return math.Max(args[0](v), args[1](v)) }, nil
+	case "log":
+		return func(v map[string]float64) float64 { return math.Log(math.Max(args[0](v), 1e-9)) }, nil
+	default:
+		return func(v map[string]float64) float64 { return math.Sqrt(math.Max(args[0](v), 0)) }, nil
+	}
+}
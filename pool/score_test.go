@@ -0,0 +1,118 @@
+package pool
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseScoreFormulaEval(t *testing.T) {
+	vars := map[string]float64{"success": 0.5, "p90": 400, "consecFail": 2, "ageHours": 100, "site": 1, "anonymity": 0.5, "kbps": 0}
+	cases := []struct {
+		formula string
+		want    float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"12 / 3 / 2", 2},
+		{"-3 + 5", 2},
+		{"--3", 3},
+		{"2 * -p90", -800},
+		{"1.5 * 2", 3},
+		{".5 * 4", 2},
+		{"min(ageHours, 72)", 72},
+		{"max(consecFail, 5)", 5},
+		{"sqrt(16)", 4},
+		{"sqrt(-4)", 0},
+		{"log(1)", 0},
+		{"p90 / kbps", 0}, // 除以 0 按 0 算
+		{"100*success + 20*site", 70},
+		{"min(max(1, 2), 3) * (1 + success)", 3},
+		{defaultScoreFormula, 100*0.5 + 20*1 + 10*0.5 + 72.0/6 - 400.0/200 - 15*2},
+	}
+	for _, c := range cases {
+		expr, err := ParseScoreFormula(c.formula)
+		if err != nil {
+			t.Errorf("%s: %v", c.formula, err)
+			continue
+		}
+		if got := expr.eval(vars); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("%s = %v, 期望 %v", c.formula, got, c.want)
+		}
+	}
+}
+
+func TestParseScoreFormulaErrors(t *testing.T) {
+	cases := []struct {
+		formula string
+		want    string // 错误信息里要有的内容
+	}{
+		{"", "公式不完整"},
+		{"1 +", "公式不完整"},
+		{"(1 + 2", "缺少 )"},
+		{"1 + 2)", "第 6 个字符无法解析"},
+		{"1..2", "第 1 个字符数字错误: 1..2"},
+		{"3 + 1.2.3", "第 5 个字符数字错误"},
+		{"speed * 2", "未知的变量: speed"},
+		{"pow(2, 3)", "未知的函数: pow"},
+		{"min(1)", "函数 min 需要 2 个参数"},
+		{"sqrt(1, 2)", "函数 sqrt 需要 1 个参数"},
+		{"max(1, 2", "函数 max 缺少 )"},
+		{"2 $ 3", "无法解析"},
+	}
+	for _, c := range cases {
+		_, err := ParseScoreFormula(c.formula)
+		if err == nil {
+			t.Errorf("%q 应该解析失败", c.formula)
+			continue
+		}
+		if !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: 错误 %q 里没有 %q", c.formula, err, c.want)
+		}
+	}
+}
+
+// 默认公式按已知的记录算分
+func TestUpdateScoreDefault(t *testing.T) {
+	useTestDir(t, "")
+	resetScoreFormula(t)
+	p := &ProxyIP{
+		IP:              "1.2.3.4:80",
+		Anonymity:       AnonymityElite,
+		ConsecutiveFail: 1,
+		History:         []CheckLog{{OK: true, Ms: 100}, {OK: true, Ms: 300}, {OK: false}, {OK: true, Ms: 200}},
+	}
+	// success 0.75 site 1 anonymity 1 ageHours 0 p90 300 consecFail 1
+	want := 100*0.75 + 20 + 10 - 300.0/200 - 15
+	if got := p.UpdateScore(); got != want {
+		t.Fatalf("分数 = %v, 期望 %v", got, want)
+	}
+	if GetScore(p.IP) != want {
+		t.Fatal("分数索引没有更新")
+	}
+}
+
+// 配置的公式错误时用默认公式
+func TestScoreFormulaFallback(t *testing.T) {
+	useTestDir(t, "scoreFormula: 100*speed\n")
+	resetScoreFormula(t)
+	p := &ProxyIP{IP: "1.2.3.5:80", History: []CheckLog{{OK: true, Ms: 200}}}
+	if got := p.UpdateScore(); got != 100+20-1 {
+		t.Fatalf("分数 = %v", got)
+	}
+
+	useTestDir(t, "scoreFormula: 10*success + kbps/100\n")
+	resetScoreFormula(t)
+	p.Kbps = 500
+	if got := p.UpdateScore(); got != 15 {
+		t.Fatalf("自定义公式分数 = %v", got)
+	}
+}
+
+func resetScoreFormula(t *testing.T) {
+	t.Helper()
+	scoreExprOnce = sync.Once{}
+	t.Cleanup(func() { scoreExprOnce = sync.Once{} })
+}
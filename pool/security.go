@@ -0,0 +1,273 @@
+package pool
+
+import (
+	"FreeProxyMange/conf"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+安全检查:
+有的免费代理会对 https 做中间人，或者往 http 响应里插广告和脚本，这种代理默认不分配
+1. TLS 拦截   通过代理 CONNECT 到 securityTlsHost，拿到的证书链校验不通过，
+              或者配置了 securityTlsPins 而证书公钥不在其中，就标记为拦截
+              公钥和直连看到的不一样但证书链合法的只记录不标记，CDN 本来就会有多张证书
+2. 内容篡改   securityStaticUrls 里的静态资源直连和通过代理各下载一次，内容哈希不一致就标记为篡改
+              代理请求失败不算篡改
+3. securityInterval  同一个ip多久做一次安全检查，默认 1h
+
+*/
+
+const (
+	defaultSecurityTlsHost   = "httpbin.org:443"
+	defaultSecurityStaticUrl = "http://httpbin.org/robots.txt"
+)
+
+// 直连结果缓存时间，和 RealIP 一样
+const securityDirectTTL = 10 * time.Minute
+
+// 静态资源最多读 2MB
+const securityMaxBody = 2 << 20
+
+// SecurityDue 是否到了该做安全检查的时间
+func (p *ProxyIP) SecurityDue() bool {
+	interval := conf.Duration("securityInterval", time.Hour)
+	return time.Since(time.Unix(p.SecurityTime, 0)) >= interval
+}
+
+// Insecure 代理是否拦截了 TLS 或篡改了内容
+func (p *ProxyIP) Insecure() bool {
+	return p.Intercepted || p.Tampered
+}
+
+// CheckSecurity 检查代理有没有拦截 TLS 和篡改内容，结果写到 Intercepted Tampered SecurityNote
+func (p *ProxyIP) CheckSecurity(ctx context.Context) {
+	p.SecurityTime = time.Now().Unix()
+	notes := make([]string, 0)
+
+	intercepted, note, err := p.checkTLS(ctx)
+	if err != nil {
+		gt.Error(p.IP, " TLS 检查失败: ", err)
+	} else {
+		p.Intercepted = intercepted
+		if note != "" {
+			notes = append(notes, note)
+		}
+	}
+
+	tampered := false
+	for _, caseUrl := range conf.List("securityStaticUrls", []string{defaultSecurityStaticUrl}) {
+		if ctx.Err() != nil {
+			return
+		}
+		ok, err := p.checkStatic(ctx, caseUrl)
+		if err != nil {
+			gt.Error(p.IP, " 内容篡改检查失败: ", err)
+			continue
+		}
+		if !ok {
+			tampered = true
+			notes = append(notes, "内容被篡改: "+caseUrl)
+		}
+	}
+	p.Tampered = tampered
+	p.SecurityNote = strings.Join(notes, "; ")
+	if p.Insecure() {
+		gt.Info(p.IP, " 安全检查不通过: ", p.SecurityNote)
+	}
+}
+
+// checkTLS 通过代理握手，返回是否被拦截和说明
+func (p *ProxyIP) checkTLS(ctx context.Context) (bool, string, error) {
+	// 只支持 http 的代理做不了 CONNECT，不用检查
+	if !p.HasProtocol(ProtocolHttps) && !p.HasProtocol(ProtocolSocks5) &&
+		!p.HasProtocol(ProtocolSocks4) && !p.HasProtocol(ProtocolSocks4a) {
+		return false, "", nil
+	}
+	hostPort := conf.Str("securityTlsHost", defaultSecurityTlsHost)
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return false, "", err
+	}
+
+	client := p.Client(10 * time.Second)
+	transport := client.Transport.(*http.Transport)
+	// 不在握手时校验，拿到证书后自己校验，这样能看到中间人给的是什么证书
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true, ServerName: host}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, "https://"+hostPort+"/", nil)
+	if err != nil {
+		return false, "", err
+	}
+	req.Header.Set("User-Agent", gt.GetAgent(gt.PCAgent))
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	_ = resp.Body.Close()
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return false, "", errors.New("没有拿到证书")
+	}
+
+	certs := resp.TLS.PeerCertificates
+	leaf := certs[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates}); err != nil {
+		return true, fmt.Sprintf("TLS 被拦截: 证书校验失败 颁发者=%s %v", leaf.Issuer.CommonName, err), nil
+	}
+
+	pin := spkiHash(leaf)
+	if pins := conf.List("securityTlsPins", nil); len(pins) > 0 {
+		for _, v := range pins {
+			if v == pin {
+				return false, "", nil
+			}
+		}
+		return true, "TLS 被拦截: 证书公钥不在 securityTlsPins 中 " + pin, nil
+	}
+
+	direct, err := directTLSPins(ctx, hostPort)
+	if err != nil {
+		gt.Error("直连获取证书失败: ", err)
+		return false, "", nil
+	}
+	if _, ok := direct[pin]; !ok {
+		return false, "证书公钥和直连不一致但证书链合法 " + pin, nil
+	}
+	return false, "", nil
+}
+
+// checkStatic 直连和通过代理各下载一次，内容一致返回 true
+func (p *ProxyIP) checkStatic(ctx context.Context, caseUrl string) (bool, error) {
+	want, err := directStaticHash(ctx, caseUrl)
+	if err != nil {
+		return true, fmt.Errorf("直连下载 %s 失败: %w", caseUrl, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, caseUrl, nil)
+	if err != nil {
+		return true, err
+	}
+	req.Header.Set("User-Agent", gt.GetAgent(gt.PCAgent))
+	req.Header.Set("Cache-Control", "no-cache")
+	resp, err := p.Client(15 * time.Second).Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return true, fmt.Errorf("返回状态码 %d", resp.StatusCode)
+	}
+	got, err := bodyHash(resp.Body)
+	if err != nil {
+		return true, err
+	}
+	return got == want, nil
+}
+
+// spkiHash 证书公钥的 sha256，base64 编码，和 HPKP 的 pin 格式一致
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func bodyHash(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.LimitReader(r, securityMaxBody)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// 直连的结果，key 为 host:port 或 url
+type securityDirect struct {
+	value string
+	pins  map[string]struct{}
+	time  time.Time
+}
+
+var (
+	securityDirectCache = make(map[string]*securityDirect)
+	securityDirectLock  sync.Mutex
+)
+
+func loadSecurityDirect(key string) (*securityDirect, bool) {
+	securityDirectLock.Lock()
+	defer securityDirectLock.Unlock()
+	v, ok := securityDirectCache[key]
+	if !ok || time.Since(v.time) > securityDirectTTL {
+		return nil, false
+	}
+	return v, true
+}
+
+func storeSecurityDirect(key string, v *securityDirect) {
+	v.time = time.Now()
+	securityDirectLock.Lock()
+	defer securityDirectLock.Unlock()
+	securityDirectCache[key] = v
+}
+
+// directTLSPins 直连看到的证书公钥
+func directTLSPins(ctx context.Context, hostPort string) (map[string]struct{}, error) {
+	old, ok := loadSecurityDirect(hostPort)
+	if ok {
+		return old.pins, nil
+	}
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: 10 * time.Second}}
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("没有拿到证书")
+	}
+	pins := map[string]struct{}{spkiHash(certs[0]): {}}
+	storeSecurityDirect(hostPort, &securityDirect{pins: pins})
+	return pins, nil
+}
+
+// directStaticHash 直连下载静态资源的内容哈希
+func directStaticHash(ctx context.Context, caseUrl string) (string, error) {
+	if v, ok := loadSecurityDirect(caseUrl); ok {
+		return v.value, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, caseUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", gt.GetAgent(gt.PCAgent))
+	req.Header.Set("Cache-Control", "no-cache")
+	resp, err := (&http.Client{Timeout: 15 * time.Second}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("返回状态码 %d", resp.StatusCode)
+	}
+	sum, err := bodyHash(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	storeSecurityDirect(caseUrl, &securityDirect{value: sum})
+	return sum, nil
+}
@@ -0,0 +1,80 @@
+package pool
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 往响应里插脚本的代理标记为篡改，原样转发的不标记
+func TestCheckSecurityTampered(t *testing.T) {
+	static := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("User-agent: *\nDisallow: /deny\n"))
+	}))
+	defer static.Close()
+	caseUrl := static.URL + "/robots.txt"
+	useTestDir(t, "securityStaticUrls: ["+caseUrl+"]\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	clean := &ProxyIP{IP: newTestProxy(t, nil), Type: ProtocolHttp}
+	clean.CheckSecurity(ctx)
+	if clean.Insecure() || clean.SecurityNote != "" || clean.SecurityTime == 0 {
+		t.Fatalf("原样转发的代理: tampered=%v note=%q", clean.Tampered, clean.SecurityNote)
+	}
+
+	inject := func(body []byte) []byte {
+		return append(body, "<script src=//ad.example.com/a.js></script>"...)
+	}
+	bad := &ProxyIP{IP: newTestProxy(t, inject), Type: ProtocolHttp}
+	bad.CheckSecurity(ctx)
+	if !bad.Tampered || !bad.Insecure() {
+		t.Fatalf("插脚本的代理没有标记为篡改: %+v", bad)
+	}
+	if !strings.Contains(bad.SecurityNote, caseUrl) {
+		t.Fatalf("SecurityNote = %q", bad.SecurityNote)
+	}
+
+	// 代理请求失败不算篡改，上一次的结果会被这次覆盖
+	bad.IP = "127.0.0.1:1"
+	bad.CheckSecurity(ctx)
+	if bad.Tampered {
+		t.Fatalf("代理连不上也标记成了篡改")
+	}
+}
+
+// 代理给的证书链校验不通过标记为拦截
+func TestCheckSecurityIntercepted(t *testing.T) {
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer site.Close()
+	static := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("static"))
+	}))
+	defer static.Close()
+	// httptest 的证书是自签的，相当于中间人换了证书
+	useTestDir(t, "securityTlsHost: "+strings.TrimPrefix(site.URL, "https://")+"\n"+
+		"securityStaticUrls: ["+static.URL+"/]\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p := &ProxyIP{IP: newTestProxy(t, nil), Type: ProtocolHttp, Protocols: []string{ProtocolHttp, ProtocolHttps}}
+	p.CheckSecurity(ctx)
+	if !p.Intercepted || !p.Insecure() || p.Tampered {
+		t.Fatalf("intercepted=%v tampered=%v note=%q", p.Intercepted, p.Tampered, p.SecurityNote)
+	}
+	if !strings.Contains(p.SecurityNote, "TLS 被拦截") {
+		t.Fatalf("SecurityNote = %q", p.SecurityNote)
+	}
+
+	// 只支持 http 的代理做不了 CONNECT，不检查 TLS
+	plain := &ProxyIP{IP: p.IP, Type: ProtocolHttp, Protocols: []string{ProtocolHttp}}
+	plain.CheckSecurity(ctx)
+	if plain.Insecure() {
+		t.Fatalf("只支持 http 的代理: %q", plain.SecurityNote)
+	}
+}
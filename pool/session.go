@@ -0,0 +1,90 @@
+package pool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+粘性会话:
+target 的会话存在 ./session，key 是会话名，重启后和租约一起恢复
+
+*/
+
+const SessionDBPath = "./session"
+
+// Session 会话绑定的ip和租约
+type Session struct {
+	Key       string `json:"key"`
+	IP        string `json:"ip"`
+	LeaseID   string `json:"leaseId"`
+	Holder    string `json:"holder"`
+	CreatedAt int64  `json:"createdAt"`
+	LastUsed  int64  `json:"lastUsed"` // 最后一次使用时间
+	ExpireAt  int64  `json:"expireAt"` // 空闲到这个时间会话删除
+	Rebinds   int    `json:"rebinds"`  // 换绑次数
+}
+
+// SaveSession 新增或更新会话
+func SaveSession(s *Session) error {
+	if s == nil || s.Key == "" {
+		return errors.New("会话的key不能为空")
+	}
+	valueBytes, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("会话序列化失败: %w", err)
+	}
+	db, err := openDB(SessionDBPath)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(s.Key), valueBytes)
+	})
+}
+
+// DeleteSession 删除会话，不存在不报错
+func DeleteSession(key string) error {
+	db, err := openDB(SessionDBPath)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(key))
+	})
+}
+
+// AllSessions 读取所有会话
+func AllSessions() ([]*Session, error) {
+	db, err := openDB(SessionDBPath)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Session, 0)
+	err = db.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			valueBytes, err := iter.Item().ValueCopy(nil)
+			if err != nil {
+				return fmt.Errorf("拷贝值失败: %w", err)
+			}
+			var s Session
+			if err := json.Unmarshal(valueBytes, &s); err != nil {
+				gt.Error("会话反序列化失败: ", string(iter.Item().Key()), err)
+				continue
+			}
+			list = append(list, &s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("读取会话失败: %w", err)
+	}
+	return list, nil
+}
@@ -0,0 +1,230 @@
+package pool
+
+import (
+	"FreeProxyMange/conf"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+目标网站验证:
+爬虫关心的是代理能不能访问具体的网站，在配置文件 sites 里定义每个网站的验证规则，
+每次检查通过后再逐个验证这些网站，结果按网站名存到 ProxyIP.Sites，
+当前验证通过的网站名用逗号拼接存到 ProxyIP.Site，/get?site=名称 只返回该网站验证通过的代理
+
+sites:
+  shop:
+    url: https://shop.example.com/
+    status: 200                       # 期望的状态码，不配置默认 200
+    body: 加入购物车                   # 响应里必须包含的内容，可以不配置
+    banStatus: [403, 429]             # 返回这些状态码说明代理被封了
+    banText: [captcha, 验证码]         # 响应里包含这些内容说明代理被封了
+    timeout: 10s
+
+*/
+
+type SiteProfile struct {
+	Name      string
+	Url       string
+	Status    int
+	Body      string
+	BanStatus []int
+	BanText   []string
+	Timeout   time.Duration
+}
+
+// SiteResult 代理在某个网站上的验证结果
+type SiteResult struct {
+	OK         bool   `json:"ok"`
+	Banned     bool   `json:"banned"`     // 命中了封禁规则
+	Status     int    `json:"status"`     // 最后一次的状态码
+	Ms         int64  `json:"ms"`         // 最后一次的响应时间
+	Reason     string `json:"reason"`     // 验证失败的原因
+	CheckTime  int64  `json:"checkTime"`  // 最后验证时间
+	SuccessNum int    `json:"successNum"` // 累计验证通过次数
+	FailNum    int    `json:"failNum"`    // 累计验证失败次数
+}
+
+var (
+	siteProfiles     []*SiteProfile
+	siteProfilesOnce sync.Once
+)
+
+// SiteProfiles 配置的所有网站验证规则，按名称排序
+func SiteProfiles() []*SiteProfile {
+	siteProfilesOnce.Do(func() {
+		siteProfiles = parseSiteProfiles(conf.Get("sites"))
+	})
+	return siteProfiles
+}
+
+func GetSiteProfile(name string) (*SiteProfile, bool) {
+	for _, s := range SiteProfiles() {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+func parseSiteProfiles(v interface{}) []*SiteProfile {
+	list := make([]*SiteProfile, 0)
+	sites, ok := v.(map[string]interface{})
+	if !ok {
+		return list
+	}
+	for name, item := range sites {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			gt.Error("网站验证规则格式错误: ", name)
+			continue
+		}
+		s := &SiteProfile{
+			Name:    name,
+			Url:     gt.Any2String(m["url"]),
+			Status:  http.StatusOK,
+			Body:    gt.Any2String(m["body"]),
+			Timeout: 10 * time.Second,
+		}
+		if s.Url == "" {
+			gt.Error("网站验证规则没有配置 url: ", name)
+			continue
+		}
+		if m["status"] != nil {
+			s.Status = gt.Any2Int(m["status"])
+		}
+		if m["timeout"] != nil {
+			if d, err := time.ParseDuration(gt.Any2String(m["timeout"])); err == nil {
+				s.Timeout = d
+			}
+		}
+		for _, v := range gt.Any2Arr(m["banStatus"]) {
+			s.BanStatus = append(s.BanStatus, gt.Any2Int(v))
+		}
+		for _, v := range gt.Any2Arr(m["banText"]) {
+			s.BanText = append(s.BanText, gt.Any2String(v))
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// SiteOK 代理当前是否通过了该网站的验证
+func (p *ProxyIP) SiteOK(name string) bool {
+	if p.Sites == nil {
+		return false
+	}
+	r, ok := p.Sites[name]
+	return ok && r.OK
+}
+
+// CheckSites 通过代理验证所有配置的网站，更新 Sites 和 Site
+func (p *ProxyIP) CheckSites(ctx context.Context) {
+	profiles := SiteProfiles()
+	if len(profiles) == 0 {
+		return
+	}
+	if p.Sites == nil {
+		p.Sites = make(map[string]*SiteResult)
+	}
+	passed := make([]string, 0, len(profiles))
+	for _, s := range profiles {
+		if ctx.Err() != nil {
+			return
+		}
+		r, ok := p.Sites[s.Name]
+		if !ok {
+			r = &SiteResult{}
+			p.Sites[s.Name] = r
+		}
+		s.check(ctx, p, r)
+		if r.OK {
+			passed = append(passed, s.Name)
+		}
+	}
+	// 已经从配置里删掉的网站不再保留
+	for name := range p.Sites {
+		if _, ok := GetSiteProfile(name); !ok {
+			delete(p.Sites, name)
+		}
+	}
+	p.Site = strings.Join(passed, ",")
+}
+
+func (s *SiteProfile) check(ctx context.Context, p *ProxyIP, r *SiteResult) {
+	r.CheckTime = time.Now().Unix()
+	status, body, ms, err := siteGet(ctx, p, s.Url, s.Timeout)
+	r.Status = status
+	r.Ms = ms
+	r.Banned = false
+	reason := ""
+	switch {
+	case err != nil:
+		reason = err.Error()
+	case s.banned(status, body):
+		r.Banned = true
+		reason = "命中封禁规则"
+	case status != s.Status:
+		reason = fmt.Sprintf("状态码 %d 不是 %d", status, s.Status)
+	case s.Body != "" && !strings.Contains(body, s.Body):
+		reason = "响应里没有 " + s.Body
+	}
+	r.OK = reason == ""
+	r.Reason = reason
+	if r.OK {
+		r.SuccessNum++
+	} else {
+		r.FailNum++
+		gt.Info(p.IP, " 验证网站 ", s.Name, " 失败: ", reason)
+	}
+}
+
+func (s *SiteProfile) banned(status int, body string) bool {
+	for _, v := range s.BanStatus {
+		if v == status {
+			return true
+		}
+	}
+	for _, v := range s.BanText {
+		if v != "" && strings.Contains(body, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// 验证网站的响应体最多读 1MB
+const siteBodyLimit = 1 << 20
+
+// 通过代理请求网站，非 2xx 的响应也需要读取响应体判断有没有被封
+func siteGet(ctx context.Context, p *ProxyIP, caseUrl string, timeout time.Duration) (int, string, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, caseUrl, nil)
+	if err != nil {
+		return 0, "", 0, err
+	}
+	req.Header.Set("User-Agent", gt.GetAgent(gt.PCAgent))
+	start := time.Now()
+	resp, err := p.Client(timeout).Do(req)
+	if err != nil {
+		return 0, "", time.Since(start).Milliseconds(), err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, siteBodyLimit))
+	ms := time.Since(start).Milliseconds()
+	if err != nil {
+		return resp.StatusCode, "", ms, err
+	}
+	return resp.StatusCode, string(body), ms, nil
+}
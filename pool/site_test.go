@@ -0,0 +1,74 @@
+package pool
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 按测试的配置重新读取网站验证规则
+func resetSiteProfiles(t *testing.T) {
+	t.Helper()
+	siteProfilesOnce = sync.Once{}
+	t.Cleanup(func() { siteProfilesOnce = sync.Once{} })
+}
+
+// 两个网站一个验证通过一个被封，结果记到 Sites、Site 和分数的 site 变量
+func TestCheckSites(t *testing.T) {
+	shop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<button>加入购物车</button>"))
+	}))
+	defer shop.Close()
+	var unbanned atomic.Bool
+	search := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unbanned.Load() {
+			_, _ = w.Write([]byte("ok"))
+			return
+		}
+		_, _ = w.Write([]byte("请输入验证码 captcha"))
+	}))
+	defer search.Close()
+	useTestDir(t, "sites:\n"+
+		"  shop:\n    url: "+shop.URL+"/\n    body: 加入购物车\n"+
+		"  search:\n    url: "+search.URL+"/\n    banText: [captcha]\n")
+	resetSiteProfiles(t)
+
+	p := &ProxyIP{IP: newTestProxy(t, nil), Type: ProtocolHttp}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p.CheckSites(ctx)
+
+	if !p.SiteOK("shop") || p.SiteOK("search") || p.SiteOK("other") {
+		t.Fatalf("验证结果不对: %+v %+v", p.Sites["shop"], p.Sites["search"])
+	}
+	if r := p.Sites["search"]; !r.Banned || r.FailNum != 1 || r.Reason == "" {
+		t.Fatalf("被封的网站: %+v", r)
+	}
+	if r := p.Sites["shop"]; r.Status != 200 || r.SuccessNum != 1 {
+		t.Fatalf("通过的网站: %+v", r)
+	}
+	if p.Site != "shop" {
+		t.Fatalf("Site = %q", p.Site)
+	}
+	if site := p.ScoreVars()["site"]; site != 0.5 {
+		t.Fatalf("分数变量 site = %v", site)
+	}
+
+	// 再验证一次都通过，site 变成 1，累计次数增加
+	unbanned.Store(true)
+	p.CheckSites(ctx)
+	if p.Site != "search,shop" || p.ScoreVars()["site"] != 1 || p.Sites["shop"].SuccessNum != 2 {
+		t.Fatalf("第二次验证: Site = %q %+v", p.Site, p.Sites["shop"])
+	}
+}
+
+func TestSiteOKWithoutResults(t *testing.T) {
+	p := &ProxyIP{}
+	if p.SiteOK("shop") {
+		t.Fatal("没有验证过的网站不算通过")
+	}
+}
@@ -0,0 +1,203 @@
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+/*
+
+SOCKS4/4a 和 SOCKS5 客户端握手
+只实现 CONNECT 命令，用于协议探测和通过 socks 代理发请求
+
+*/
+
+var (
+	ErrSocksReply      = errors.New("socks 代理拒绝了连接请求")
+	ErrSocksNoMethod   = errors.New("socks5 代理不支持无认证或账号密码认证")
+	ErrSocksNeedAuth   = errors.New("socks5 代理需要账号密码认证")
+	ErrSocksAuthFailed = errors.New("socks5 代理账号密码认证失败")
+)
+
+// socks4Connect 在已建立的连接上完成 SOCKS4 握手，userid 可以为空
+// socks4a 为 true 时把域名交给代理解析，否则本地解析成 IPv4
+func socks4Connect(conn net.Conn, target, userid string, socks4a bool) error {
+	host, port, err := splitHostPort(target)
+	if err != nil {
+		return err
+	}
+
+	domain := ""
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		if socks4a {
+			// 0.0.0.x 表示由代理解析后面附带的域名
+			ip = net.IPv4(0, 0, 0, 1).To4()
+			domain = host
+		} else {
+			ip, err = lookupIPv4(host)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	req := []byte{0x04, 0x01, byte(port >> 8), byte(port)}
+	req = append(req, ip...)
+	req = append(req, []byte(userid)...)
+	req = append(req, 0x00)
+	if domain != "" {
+		req = append(req, []byte(domain)...)
+		req = append(req, 0x00)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("socks4 写入请求失败: %w", err)
+	}
+
+	resp := make([]byte, 8)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return fmt.Errorf("socks4 读取响应失败: %w", err)
+	}
+	if resp[0] != 0x00 || resp[1] != 0x5a {
+		return ErrSocksReply
+	}
+	return nil
+}
+
+// socks5Connect 在已建立的连接上完成 SOCKS5 握手
+// user 不为空时同时支持账号密码认证，remoteDNS 为 true 时域名交给代理解析，否则本地解析
+func socks5Connect(conn net.Conn, target, user, pass string, remoteDNS bool) error {
+	host, port, err := splitHostPort(target)
+	if err != nil {
+		return err
+	}
+	if !remoteDNS && net.ParseIP(host) == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return err
+		}
+		if len(ips) == 0 {
+			return fmt.Errorf("%s 没有解析到IP", host)
+		}
+		host = ips[0].String()
+	}
+
+	methods := []byte{0x00}
+	if user != "" {
+		methods = append(methods, 0x02)
+	}
+	req := append([]byte{0x05, byte(len(methods))}, methods...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("socks5 写入认证方式失败: %w", err)
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return fmt.Errorf("socks5 读取认证方式失败: %w", err)
+	}
+	if resp[0] != 0x05 {
+		return fmt.Errorf("不是 socks5 代理, 版本号 %d", resp[0])
+	}
+
+	switch resp[1] {
+	case 0x00:
+	case 0x02:
+		if user == "" {
+			return ErrSocksNeedAuth
+		}
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("socks5 账号或密码过长")
+		}
+		auth := []byte{0x01, byte(len(user))}
+		auth = append(auth, []byte(user)...)
+		auth = append(auth, byte(len(pass)))
+		auth = append(auth, []byte(pass)...)
+		if _, err := conn.Write(auth); err != nil {
+			return fmt.Errorf("socks5 写入账号密码失败: %w", err)
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return fmt.Errorf("socks5 读取认证结果失败: %w", err)
+		}
+		if resp[1] != 0x00 {
+			return ErrSocksAuthFailed
+		}
+	default:
+		return ErrSocksNoMethod
+	}
+
+	req = []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, 0x01)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, 0x04)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("socks5 域名过长")
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, []byte(host)...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("socks5 写入请求失败: %w", err)
+	}
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return fmt.Errorf("socks5 读取响应失败: %w", err)
+	}
+	if head[1] != 0x00 {
+		return ErrSocksReply
+	}
+	// 读掉代理返回的绑定地址和端口
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = 4
+	case 0x04:
+		skip = 16
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return fmt.Errorf("socks5 读取响应失败: %w", err)
+		}
+		skip = int(l[0])
+	default:
+		return fmt.Errorf("socks5 未知的地址类型 %d", head[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return fmt.Errorf("socks5 读取响应失败: %w", err)
+	}
+	return nil
+}
+
+func splitHostPort(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("端口错误: %s", portStr)
+	}
+	return host, port, nil
+}
+
+func lookupIPv4(host string) (net.IP, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4, nil
+		}
+	}
+	return nil, fmt.Errorf("%s 没有 IPv4 地址", host)
+}
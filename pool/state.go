@@ -0,0 +1,248 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+代理生命周期状态:
+状态存在池子的记录里，检查、分配、归还都通过 SetState 修改，重启后按池子里的状态恢复
+
+new          新入池，还没检查过
+validating   检查中，新入池、冷却和隔离的ip检查时进入这个状态，可用的ip复查时保持可用
+available    检查通过，可以分配，拦截篡改的也是可用，只是默认不分配
+leased       已分配出去，检查结果不改变状态，只有死亡和隔离会打断
+cooling      检查失败，按失败策略退避后重新检查
+quarantined  被封，继续低频检查，恢复正常后重新可用
+dead         同一类失败达到 failPolicy 的删除次数，放入墓地低频做复活检查，见 graveyard.go
+
+new -> validating -> available <-> leased
+                  -> cooling / quarantined / dead
+cooling / quarantined / dead -> validating
+
+*/
+
+const (
+	StateNew         = "new"
+	StateValidating  = "validating"
+	StateAvailable   = "available"
+	StateLeased      = "leased"
+	StateCooling     = "cooling"
+	StateQuarantined = "quarantined"
+	StateDead        = "dead"
+)
+
+var States = []string{StateNew, StateValidating, StateAvailable, StateLeased, StateCooling, StateQuarantined, StateDead}
+
+// 允许的状态转换，同一个状态之间的转换不算变化
+var stateTransitions = map[string][]string{
+	StateNew:         {StateValidating, StateDead},
+	StateValidating:  {StateAvailable, StateCooling, StateQuarantined, StateDead},
+	StateAvailable:   {StateLeased, StateCooling, StateQuarantined, StateDead},
+	StateLeased:      {StateAvailable, StateCooling, StateQuarantined, StateDead},
+	StateCooling:     {StateValidating, StateDead},
+	StateQuarantined: {StateValidating, StateDead},
+	StateDead:        {StateValidating},
+}
+
+var ErrBadTransition = errors.New("不允许的状态转换")
+
+// 每个ip最多保留的状态变化记录
+const stateHistorySize = 20
+
+// StateChange 一次状态变化
+type StateChange struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Time   int64  `json:"time"`
+	Reason string `json:"reason"`
+}
+
+func IsState(state string) bool {
+	for _, s := range States {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+func CanTransition(from, to string) bool {
+	if from == to {
+		return true
+	}
+	for _, s := range stateTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition 校验并修改状态，记录时间和原因，不写库
+func (p *ProxyIP) Transition(to, reason string) error {
+	from := p.State
+	if from == "" {
+		from = StateNew
+	}
+	if !CanTransition(from, to) {
+		return fmt.Errorf("%w: %s %s -> %s", ErrBadTransition, p.IP, from, to)
+	}
+	if from == to {
+		p.State = to
+		stateIndex.Set(p.IP, to)
+		return nil
+	}
+	now := time.Now().Unix()
+	p.State = to
+	p.StateTime = now
+	p.StateHistory = append(p.StateHistory, StateChange{From: from, To: to, Time: now, Reason: reason})
+	if len(p.StateHistory) > stateHistorySize {
+		p.StateHistory = p.StateHistory[len(p.StateHistory)-stateHistorySize:]
+	}
+	stateIndex.Set(p.IP, to)
+	return nil
+}
+
+// 同一个ip的读改写加锁，分段减少锁的数量
+var ipLocks [64]sync.Mutex
+
+func lockIP(ip string) func() {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(ip))
+	l := &ipLocks[hash.Sum32()%uint32(len(ipLocks))]
+	l.Lock()
+	return l.Unlock
+}
+
+// SetState 修改池子里ip的状态并写库，返回修改后的记录
+func SetState(ip, to, reason string) (*ProxyIP, error) {
+	unlock := lockIP(ip)
+	defer unlock()
+	p, ok, err := Get(ip)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("池子里没有 %s", ip)
+	}
+	if err := p.Transition(to, reason); err != nil {
+		return nil, err
+	}
+	if err := BadgerUpsertStruct(DBPath(ip), ip, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// 旧数据没有状态，按检查结果推断
+func (p *ProxyIP) inferState() string {
+	switch {
+	case p.CheckNum == 0 && p.ConsecutiveFail == 0:
+		return StateNew
+	case p.ConsecutiveFail > 0:
+		return StateCooling
+	default:
+		return StateAvailable
+	}
+}
+
+// 每个ip当前状态的内存索引，统计和按状态查找用
+type stateIndexMap struct {
+	lock sync.RWMutex
+	byIP map[string]string
+}
+
+var stateIndex = &stateIndexMap{byIP: make(map[string]string)}
+
+func (s *stateIndexMap) Set(ip, state string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.byIP[ip] = state
+}
+
+func (s *stateIndexMap) Remove(ip string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.byIP, ip)
+}
+
+func (s *stateIndexMap) Get(ip string) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.byIP[ip]
+}
+
+// StateCounts 每个状态的ip数量
+func StateCounts() map[string]int {
+	stateIndex.lock.RLock()
+	defer stateIndex.lock.RUnlock()
+	counts := make(map[string]int, len(States))
+	for _, s := range States {
+		counts[s] = 0
+	}
+	for _, s := range stateIndex.byIP {
+		counts[s]++
+	}
+	return counts
+}
+
+// IPsInState 处于该状态的所有ip，按分数排序
+func IPsInState(state string) []string {
+	stateIndex.lock.RLock()
+	ips := make([]string, 0)
+	for ip, s := range stateIndex.byIP {
+		if s == state {
+			ips = append(ips, ip)
+		}
+	}
+	stateIndex.lock.RUnlock()
+	sort.Strings(ips)
+	SortByScore(ips)
+	return ips
+}
+
+// ListByState 读取处于该状态的所有ip的记录
+func ListByState(state string) []*ProxyIP {
+	list := make([]*ProxyIP, 0)
+	for _, ip := range IPsInState(state) {
+		p, ok, err := Get(ip)
+		if err != nil {
+			gt.Error(err)
+			continue
+		}
+		if ok && p.State == state {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// 池子加载完成，target 等加载完再按状态恢复分配情况
+var (
+	ready     = make(chan struct{})
+	readyOnce sync.Once
+)
+
+func setReady() {
+	readyOnce.Do(func() { close(ready) })
+}
+
+// WaitReady 等待池子加载完成，ctx 取消返回 false
+func WaitReady(ctx context.Context) bool {
+	select {
+	case <-ready:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
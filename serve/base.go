@@ -6,6 +6,8 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,6 +27,16 @@ func Run(ctx context.Context, wg *sync.WaitGroup) {
 		mux.HandleFunc("/get", getHandler)
 		mux.HandleFunc("/useList", useShowHandler)
 		mux.HandleFunc("/notuseList", notuseShowHandler)
+		mux.HandleFunc("/judge", judgeHandler)
+		mux.HandleFunc("/checkStats", checkStatsHandler)
+		mux.HandleFunc("/exitGroups", exitGroupsHandler)
+		mux.HandleFunc("/stateStats", stateStatsHandler)
+		mux.HandleFunc("/renew", renewHandler)
+		mux.HandleFunc("/release", releaseHandler)
+		mux.HandleFunc("/feedback", feedbackHandler)
+		mux.HandleFunc("/sessions", sessionsHandler)
+		mux.HandleFunc("/sessionDelete", sessionDeleteHandler)
+		mux.HandleFunc("/domainUsage", domainUsageHandler)
 
 		// 启动 HTTP 服务，监听 8080 端口
 		httpServer := &http.Server{
@@ -32,6 +44,8 @@ func Run(ctx context.Context, wg *sync.WaitGroup) {
 			Handler: ResponseHeaderMiddleware(mux), // 中间件包裹所有路由
 		}
 
+		judgeServer := startJudgeServer()
+
 		// 2. 启动 HTTP 服务的 goroutine（非阻塞）
 		serverErrChan := make(chan error, 1)
 		go func() {
@@ -58,6 +72,9 @@ func Run(ctx context.Context, wg *sync.WaitGroup) {
 			} else {
 				gt.Info("HTTP 服务已优雅关停")
 			}
+			if judgeServer != nil {
+				_ = judgeServer.Shutdown(shutdownCtx)
+			}
 
 			// 模拟其他收尾逻辑（如关闭数据库、清理资源）
 			time.Sleep(1 * time.Second)
@@ -93,6 +110,44 @@ func allHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 按生命周期状态筛选，走内存索引，不分页
+	if state := r.URL.Query().Get("state"); state != "" {
+		if !pool.IsState(state) {
+			_ = json.NewEncoder(w).Encode(Response{
+				Code:    200,
+				Message: "state 只支持 " + strings.Join(pool.States, " "),
+				Data:    nil,
+			})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: "获取数据成功",
+			Data:    pool.IPsInState(state),
+		})
+		return
+	}
+
+	// 按出口国家和 ASN 筛选，走内存索引，不分页
+	countries := queryList(r, "country")
+	asns, bad := queryUints(r, "asn")
+	if bad != "" {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: "asn 只支持数字，例如 13335 或 AS13335: " + bad,
+			Data:    nil,
+		})
+		return
+	}
+	if len(countries) > 0 || len(asns) > 0 {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: "获取数据成功",
+			Data:    pool.FindByGeo(countries, asns),
+		})
+		return
+	}
+
 	pageStr := r.URL.Query().Get("page")
 	gt.Info("pageStr = ", pageStr)
 
@@ -126,12 +181,20 @@ func addHandler(w http.ResponseWriter, r *http.Request) {
 			Message: "ip不能为空",
 			Data:    "",
 		})
+		return
 	}
 
-	ipData := &pool.ProxyIP{
-		IP: ipStr,
+	// 支持 ip:port 和 socks5://user:pass@ip:port 这种带协议和账号密码的格式
+	ipData, err := pool.ParseProxy(ipStr)
+	if err != nil {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: "ip格式错误",
+			Data:    err.Error(),
+		})
+		return
 	}
-	err := ipData.Add()
+	err = ipData.Add()
 	if err != nil {
 		_ = json.NewEncoder(w).Encode(Response{
 			Code:    200,
@@ -172,9 +235,10 @@ func checkHandler(w http.ResponseWriter, r *http.Request) {
 			Message: "ip不能为空",
 			Data:    "",
 		})
+		return
 	}
 
-	res := pool.Check(ipStr)
+	res := pool.Check(r.Context(), ipStr)
 
 	// 4. 返回 JSON 响应
 	_ = json.NewEncoder(w).Encode(Response{
@@ -185,19 +249,159 @@ func checkHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// getHandler 分配一个代理，筛选参数都可以不传:
+// type=https  domain=shop.example.com  country=US,CA  asn=13335  max_ms=800  anonymity=elite  site=shop
+// min_kbps=1000  exclude=1.2.3.4:80,5.6.7.8  insecure=1  strategy=round-robin  lease=5m  holder=名称
+// wait=30s 没有时等待，见 target.WaitIP
+// 传了 count 批量分配，见 getBatch，传了 session 使用粘性会话，见 getSession
+// 没有符合条件的代理返回 404
 func getHandler(w http.ResponseWriter, r *http.Request) {
-	ip := target.UseIP()
-	// 4. 返回 JSON 响应
+	anonymity := r.URL.Query().Get("anonymity")
+	if anonymity != "" && !pool.IsAnonymity(anonymity) {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: "anonymity 只支持 transparent anonymous elite",
+			Data:    "",
+		})
+		return
+	}
+
+	site := r.URL.Query().Get("site")
+	if _, ok := pool.GetSiteProfile(site); site != "" && !ok {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: "没有配置该网站的验证规则: " + site,
+			Data:    "",
+		})
+		return
+	}
+
+	protocol := r.URL.Query().Get("type")
+	if protocol != "" && !pool.IsProtocol(protocol) {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: "type 只支持 http https socks4 socks4a socks5",
+			Data:    "",
+		})
+		return
+	}
+
+	asns, bad := queryUints(r, "asn")
+	if bad != "" {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: "asn 只支持数字，例如 13335 或 AS13335: " + bad,
+			Data:    "",
+		})
+		return
+	}
+
+	numbers := make(map[string]int64, 2)
+	for _, key := range []string{"max_ms", "min_kbps"} {
+		n, ok := queryInt64(r, key)
+		if !ok {
+			_ = json.NewEncoder(w).Encode(Response{
+				Code:    200,
+				Message: key + " 只支持不小于 0 的整数: " + r.URL.Query().Get(key),
+				Data:    "",
+			})
+			return
+		}
+		numbers[key] = n
+	}
+
+	filter := &target.Filter{
+		Type:      protocol,
+		MaxMs:     numbers["max_ms"],
+		Exclude:   queryList(r, "exclude"),
+		Domain:    r.URL.Query().Get("domain"),
+		Anonymity: anonymity,
+		Site:      site,
+		Countries: queryList(r, "country"),
+		ASNs:      asns,
+		MinKbps:   numbers["min_kbps"],
+		Insecure:  r.URL.Query().Get("insecure") == "1",
+	}
+	holder := holderOf(r)
+	strategy, ok := target.StrategyFor(r.URL.Query().Get("strategy"), holder)
+	if !ok {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: "strategy 只支持 " + strings.Join(target.StrategyNames(), " "),
+			Data:    "",
+		})
+		return
+	}
+	if r.URL.Query().Has("count") && r.URL.Query().Has("session") {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: "count 和 session 不能同时使用",
+			Data:    "",
+		})
+		return
+	}
+	for _, key := range []string{"wait", "lease"} {
+		if !validDuration(r, key) {
+			_ = json.NewEncoder(w).Encode(Response{
+				Code:    200,
+				Message: key + " 格式错误，例如 30s 或者 30(秒)",
+				Data:    "",
+			})
+			return
+		}
+	}
+	if r.URL.Query().Has("wait") && (r.URL.Query().Has("count") || r.URL.Query().Has("session")) {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: "wait 不能和 count、session 同时使用",
+			Data:    "",
+		})
+		return
+	}
+	if r.URL.Query().Has("count") {
+		getBatch(w, r, filter, strategy, holder, protocol)
+		return
+	}
+	if r.URL.Query().Has("session") {
+		getSession(w, r, filter, strategy, holder, protocol)
+		return
+	}
+	// 不等待的也走等待队列，有人在排队时不能插到前面
+	ip, lease := target.WaitIP(r.Context(), filter, strategy, holder, queryDuration(r, "lease"), queryDuration(r, "wait"))
+	if ip == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    404,
+			Message: "没有符合条件的代理",
+			Data:    "",
+		})
+		return
+	}
+	// 返回带协议头的代理地址，例如 http://ip:port socks5h://user:pass@ip:port，租约和完整记录
 	_ = json.NewEncoder(w).Encode(Response{
 		Code:    200,
 		Message: "",
-		Data:    ip,
+		Data: GetResult{
+			Proxy: ip.ProxyUrlFor(protocol),
+			Lease: lease,
+			IP:    ip,
+		},
 	})
 
 }
 
+// /useList?limit=100 租约很多时只返回 limit 个，total 是总数
+const maxUseListLimit = 1000
+
 func useShowHandler(w http.ResponseWriter, r *http.Request) {
-	ip := target.ShowUse()
+	limit := gt.Any2Int(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = 100
+	}
+	if limit > maxUseListLimit {
+		limit = maxUseListLimit
+	}
+	ip := target.ShowUse(limit)
 	// 4. 返回 JSON 响应
 	_ = json.NewEncoder(w).Encode(Response{
 		Code:    200,
@@ -218,6 +422,54 @@ func notuseShowHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// 检查调度器的队列深度和吞吐
+func checkStatsHandler(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(Response{
+		Code:    200,
+		Message: "",
+		Data:    pool.Checker.Metrics(),
+	})
+}
+
+// 逗号分隔的参数，例如 country=US,CA
+func queryList(r *http.Request, key string) []string {
+	list := make([]string, 0)
+	for _, v := range strings.Split(r.URL.Query().Get(key), ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// 逗号分隔的数字参数，例如 asn=13335,AS15169，有不是数字的返回第一个不合法的值
+func queryUints(r *http.Request, key string) ([]uint, string) {
+	list := make([]uint, 0)
+	for _, v := range queryList(r, key) {
+		// 兼容 AS13335 这种写法
+		n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(v), "AS"), 10, 32)
+		if err != nil {
+			return nil, v
+		}
+		list = append(list, uint(n))
+	}
+	return list, ""
+}
+
+// 不小于 0 的整数参数，没传返回 0，格式错误返回 false
+func queryInt64(r *http.Request, key string) (int64, bool) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return 0, true
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
 // ========== 核心：通用响应头中间件 ==========
 // ResponseHeaderMiddleware 中间件：设置通用响应头（JSON + 跨域）
 // next: 下一个处理器（被包装的路由函数）
@@ -240,3 +492,45 @@ func ResponseHeaderMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// 各出口在某个域名上的使用情况和复用限制，/domainUsage?domain=example.com
+func domainUsageHandler(w http.ResponseWriter, r *http.Request) {
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: "domain 不能为空",
+			Data:    "",
+		})
+		return
+	}
+	policy := target.GetDomainPolicy(strings.ToLower(domain))
+	_ = json.NewEncoder(w).Encode(Response{
+		Code:    200,
+		Message: "",
+		Data: map[string]interface{}{
+			"cooldown":    policy.Cooldown.String(),
+			"maxRequests": policy.MaxRequests,
+			"window":      policy.Window.String(),
+			"usage":       target.DomainUsages(domain),
+		},
+	})
+}
+
+// 多个入口代理共用同一个出口IP的分组
+func exitGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(Response{
+		Code:    200,
+		Message: "",
+		Data:    pool.ExitGroups(),
+	})
+}
+
+// 每个生命周期状态的ip数量
+func stateStatsHandler(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(Response{
+		Code:    200,
+		Message: "",
+		Data:    pool.StateCounts(),
+	})
+}
@@ -0,0 +1,96 @@
+package serve
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestQueryUints(t *testing.T) {
+	cases := []struct {
+		query string
+		want  []uint
+		bad   string
+	}{
+		{"", []uint{}, ""},
+		{"asn=13335", []uint{13335}, ""},
+		{"asn=AS13335,as15169", []uint{13335, 15169}, ""},
+		{"asn=13335,foo", nil, "foo"},
+		{"asn=AS", nil, "AS"},
+		{"asn=99999999999", nil, "99999999999"},
+	}
+	for _, c := range cases {
+		got, bad := queryUints(httptest.NewRequest("GET", "/get?"+c.query, nil), "asn")
+		if bad != c.bad || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v %q, want %v %q", c.query, got, bad, c.want, c.bad)
+		}
+	}
+}
+
+// asn 不合法时返回提示，不能当作没有筛选条件去分配
+func TestGetRejectsInvalidASN(t *testing.T) {
+	for _, path := range []string{"/get?asn=foo", "/all?asn=13335,foo"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		if strings.HasPrefix(path, "/get") {
+			getHandler(w, r)
+		} else {
+			allHandler(w, r)
+		}
+		var resp Response
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(resp.Message, "foo") {
+			t.Fatalf("%s: %+v", path, resp)
+		}
+	}
+}
+
+// 数字参数不合法时返回提示，不能当作 0 不限制
+func TestGetRejectsInvalidNumber(t *testing.T) {
+	for _, query := range []string{"max_ms=abc", "max_ms=-1", "min_kbps=1.5", "max_ms=800&min_kbps=1k"} {
+		w := httptest.NewRecorder()
+		getHandler(w, httptest.NewRequest("GET", "/get?"+query, nil))
+		var resp Response
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(resp.Message, "只支持不小于 0 的整数") {
+			t.Fatalf("%s: %+v", query, resp)
+		}
+	}
+}
+
+// 时长格式错误时返回提示，不能当作没传
+func TestRejectsInvalidDuration(t *testing.T) {
+	cases := []struct {
+		path string
+		key  string
+	}{
+		{"/get?wait=abc", "wait"},
+		{"/get?wait=5x", "wait"},
+		{"/get?wait=1.5", "wait"},
+		{"/get?lease=abc", "lease"},
+		{"/get?lease=5x&wait=1s", "lease"},
+		{"/renew?id=x&lease=1.5", "lease"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", c.path, nil)
+		if strings.HasPrefix(c.path, "/get") {
+			getHandler(w, r)
+		} else {
+			renewHandler(w, r)
+		}
+		var resp Response
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(resp.Message, c.key+" 格式错误") {
+			t.Fatalf("%s: %+v", c.path, resp)
+		}
+	}
+}
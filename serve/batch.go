@@ -0,0 +1,106 @@
+package serve
+
+import (
+	"FreeProxyMange/conf"
+	"FreeProxyMange/target"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+批量分配:
+/get?count=10&distinct=subnet,asn,country&mode=all|best
+distinct  要求 /24 网段、ASN、国家互不相同，可以组合
+mode      all 不够 count 个一个都不分配(默认)，best 有几个分配几个
+一次最多 getMaxCount 个，默认 100
+
+*/
+
+// BatchResult 批量分配的返回
+type BatchResult struct {
+	Requested int         `json:"requested"` // 请求的数量
+	Leased    int         `json:"leased"`    // 实际分配的数量
+	Mode      string      `json:"mode"`      // all 或 best
+	Complete  bool        `json:"complete"`  // 是否分配够了
+	Proxies   []GetResult `json:"proxies"`
+}
+
+func getBatch(w http.ResponseWriter, r *http.Request, filter *target.Filter, strategy target.Strategy, holder, protocol string) {
+	count := gt.Any2Int(r.URL.Query().Get("count"))
+	maxCount := conf.Int("getMaxCount", 100)
+	if count <= 0 || count > maxCount {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: fmt.Sprintf("count 必须在 1 到 %d 之间", maxCount),
+			Data:    "",
+		})
+		return
+	}
+
+	distinct, bad := target.ParseDistinct(queryList(r, "distinct"))
+	if bad != "" {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: "distinct 只支持 subnet asn country: " + bad,
+			Data:    "",
+		})
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "all"
+	}
+	if mode != "all" && mode != "best" {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: "mode 只支持 all best",
+			Data:    "",
+		})
+		return
+	}
+
+	list := target.UseIPs(filter, strategy, holder, queryDuration(r, "lease"), count, distinct, mode == "all")
+	result := BatchResult{
+		Requested: count,
+		Leased:    len(list),
+		Mode:      mode,
+		Complete:  len(list) == count,
+		Proxies:   make([]GetResult, 0, len(list)),
+	}
+	for _, a := range list {
+		result.Proxies = append(result.Proxies, GetResult{
+			Proxy: a.IP.ProxyUrlFor(protocol),
+			Lease: a.Lease,
+			IP:    a.IP,
+		})
+	}
+
+	if len(list) == 0 {
+		message := "没有符合条件的代理"
+		if mode == "all" {
+			message = fmt.Sprintf("符合条件的代理不足 %d 个，没有分配", count)
+		}
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    404,
+			Message: message,
+			Data:    result,
+		})
+		return
+	}
+
+	message := ""
+	if !result.Complete {
+		message = fmt.Sprintf("只分配到 %d/%d 个", len(list), count)
+	}
+	_ = json.NewEncoder(w).Encode(Response{
+		Code:    200,
+		Message: message,
+		Data:    result,
+	})
+}
@@ -0,0 +1,63 @@
+package serve
+
+import (
+	"FreeProxyMange/pool"
+	"FreeProxyMange/target"
+	"encoding/json"
+	"net/http"
+)
+
+/*
+
+使用方反馈:
+POST /feedback
+{"proxy":"1.2.3.4:80","leaseId":"","domain":"shop.example.com","outcome":"banned","status":403,"ms":1200,"scope":"domain"}
+proxy 和 leaseId 传一个就行，outcome 支持 success failed timeout banned captcha
+被封时 scope=domain(默认) 只在这个域名上禁用，scope=global 整个ip隔离，/get?domain= 会跳过禁用的ip
+
+*/
+
+func feedbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    405,
+			Message: "仅支持 POST 方法",
+			Data:    nil,
+		})
+		return
+	}
+
+	fb := &pool.Feedback{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(fb); err != nil {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: "参数格式错误",
+			Data:    err.Error(),
+		})
+		return
+	}
+	if err := fb.Validate(); err != nil {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: err.Error(),
+			Data:    "",
+		})
+		return
+	}
+
+	ip, err := target.Feedback(fb)
+	if err != nil {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: err.Error(),
+			Data:    "",
+		})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(Response{
+		Code:    200,
+		Message: "反馈成功",
+		Data:    ip,
+	})
+}
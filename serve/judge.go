@@ -0,0 +1,136 @@
+package serve
+
+import (
+	"FreeProxyMange/conf"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+判官接口:
+原样返回调用方的IP、所有请求头和TLS信息，返回格式兼容 httpbin.org/get
+把 judgeUrl 配置成自己部署在公网的 FreeProxyMange 的 /judge，验证代理就不用依赖第三方网站
+
+judgeAddr 不为空时额外单独监听一个端口只提供判官接口和带宽测试的 /bytes，
+同时配置了 judgeCertFile 和 judgeKeyFile 则该端口使用 https
+/bytes 一次能返回 100MB，只放在判官端口上，不挂在管理接口上
+
+*/
+
+type JudgeResponse struct {
+	Origin  string            `json:"origin"`  // 判官看到的客户端IP
+	Method  string            `json:"method"`  // 请求方法
+	Url     string            `json:"url"`     // 请求地址
+	Headers map[string]string `json:"headers"` // 所有请求头，多个值用逗号拼接
+	TLS     *JudgeTLS         `json:"tls"`     // 非https请求为 null
+}
+
+type JudgeTLS struct {
+	Version            string `json:"version"`
+	CipherSuite        string `json:"cipherSuite"`
+	ServerName         string `json:"serverName"` // SNI
+	NegotiatedProtocol string `json:"negotiatedProtocol"`
+}
+
+func judgeHandler(w http.ResponseWriter, r *http.Request) {
+	origin, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		origin = r.RemoteAddr
+	}
+
+	headers := make(map[string]string, len(r.Header)+1)
+	for k, v := range r.Header {
+		headers[k] = strings.Join(v, ",")
+	}
+	// Host 不在 r.Header 里
+	headers["Host"] = r.Host
+
+	scheme := "http"
+	var tlsInfo *JudgeTLS
+	if r.TLS != nil {
+		scheme = "https"
+		tlsInfo = &JudgeTLS{
+			Version:            tls.VersionName(r.TLS.Version),
+			CipherSuite:        tls.CipherSuiteName(r.TLS.CipherSuite),
+			ServerName:         r.TLS.ServerName,
+			NegotiatedProtocol: r.TLS.NegotiatedProtocol,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(JudgeResponse{
+		Origin:  origin,
+		Method:  r.Method,
+		Url:     scheme + "://" + r.Host + r.URL.RequestURI(),
+		Headers: headers,
+		TLS:     tlsInfo,
+	})
+}
+
+// 带宽测试最多返回 100MB
+const maxBytesSize = 100 << 20
+
+// bytesHandler 返回 size 个字节，用于通过代理测试下载带宽，本地跑测试也不依赖外网
+func bytesHandler(w http.ResponseWriter, r *http.Request) {
+	size := gt.Any2Int(r.URL.Query().Get("size"))
+	if size <= 0 {
+		size = 1 << 20
+	}
+	if size > maxBytesSize {
+		size = maxBytesSize
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	w.Header().Set("Cache-Control", "no-store")
+	buf := make([]byte, 32<<10)
+	for size > 0 {
+		n := len(buf)
+		if size < n {
+			n = size
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return
+		}
+		size -= n
+	}
+}
+
+// 单独监听的判官服务，未配置 judgeAddr 返回 nil
+func startJudgeServer() *http.Server {
+	addr := conf.Str("judgeAddr", "")
+	if addr == "" {
+		return nil
+	}
+	certFile := conf.Str("judgeCertFile", "")
+	keyFile := conf.Str("judgeKeyFile", "")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bytes", bytesHandler)
+	mux.HandleFunc("/", judgeHandler)
+	judgeServer := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	go func() {
+		var err error
+		if certFile != "" && keyFile != "" {
+			gt.Info("判官服务启动(https)，监听地址：", addr)
+			err = judgeServer.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			gt.Info("判官服务启动，监听地址：", addr)
+			err = judgeServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			gt.Error("判官服务启动失败: ", err)
+		}
+	}()
+	return judgeServer
+}
@@ -0,0 +1,125 @@
+package serve
+
+import (
+	"FreeProxyMange/conf"
+	"FreeProxyMange/pool"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 在临时目录写配置文件并加载，测试结束切回原目录
+func useConf(t *testing.T, yaml string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pool.CloseDB()
+		pool.ReopenDB()
+		_ = os.Chdir(wd)
+	})
+	if err := os.WriteFile(conf.Path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf.Init()
+}
+
+// 本地 http 转发代理，从 127.0.0.2 连判官，判官看到的出口IP和本机直连的不同
+// addHeader 模拟代理添加的请求头
+func newForwardProxy(t *testing.T, addHeader func(h http.Header, client string)) *httptest.Server {
+	t.Helper()
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")},
+			Timeout:   5 * time.Second,
+		}).DialContext,
+		DisableKeepAlives: true,
+	}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out := r.Clone(r.Context())
+		out.RequestURI = ""
+		out.Header.Del("Proxy-Connection")
+		client, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if addHeader != nil {
+			addHeader(out.Header, client)
+		}
+		resp, err := transport.RoundTrip(out)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestJudgeThroughProxy(t *testing.T) {
+	judge := httptest.NewServer(http.HandlerFunc(judgeHandler))
+	defer judge.Close()
+	useConf(t, "judgeUrl: "+judge.URL+"/get\n")
+
+	cases := []struct {
+		name      string
+		addHeader func(h http.Header, client string)
+		want      string
+	}{
+		{"elite", nil, pool.AnonymityElite},
+		{"anonymous", func(h http.Header, client string) { h.Set("Via", "1.1 test-proxy") }, pool.AnonymityAnonymous},
+		{"transparent", func(h http.Header, client string) { h.Set("X-Forwarded-For", client) }, pool.AnonymityTransparent},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			proxy := newForwardProxy(t, c.addHeader)
+			p := &pool.ProxyIP{IP: strings.TrimPrefix(proxy.URL, "http://"), Type: pool.ProtocolHttp}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			level, err := p.Judge(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if level != c.want {
+				t.Fatalf("匿名度 = %s, 期望 %s", level, c.want)
+			}
+			if p.ExitIP != "127.0.0.2" {
+				t.Fatalf("出口IP = %s, 期望 127.0.0.2", p.ExitIP)
+			}
+		})
+	}
+}
+
+func TestJudgeHandlerEcho(t *testing.T) {
+	judge := httptest.NewServer(http.HandlerFunc(judgeHandler))
+	defer judge.Close()
+	req, _ := http.NewRequest(http.MethodGet, judge.URL+"/get?a=1", nil)
+	req.Header.Set("X-Test", "v1")
+	req.Header.Add("X-Test", "v2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{`"origin":"127.0.0.1"`, `"X-Test":"v1,v2"`, `"url":"http://` + req.Host + `/get?a=1"`, `"tls":null`} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("返回里没有 %s: %s", want, body)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package serve
+
+import (
+	"FreeProxyMange/pool"
+	"FreeProxyMange/target"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+租约接口:
+/get?lease=5m&holder=名称     分配时指定使用时长和使用方，返回代理地址和租约
+/renew?id=租约ID&lease=5m     续租，从现在开始重新计算到期时间
+/release?id=租约ID&outcome=success|failed|banned  用完归还，带上使用结果
+/useList                      所有租约，包含使用方和到期时间
+
+*/
+
+// GetResult /get 的返回
+type GetResult struct {
+	Proxy string        `json:"proxy"` // 带协议头的代理地址，指定了 type 按该协议拼接
+	Lease *pool.Lease   `json:"lease"`
+	IP    *pool.ProxyIP `json:"ip"` // 完整记录
+
+	Session *pool.Session `json:"session,omitempty"` // 使用粘性会话时的会话
+	Rebind  bool          `json:"rebind,omitempty"`  // 会话原来的ip不能用了，这次换绑了新的
+}
+
+func renewHandler(w http.ResponseWriter, r *http.Request) {
+	if !validDuration(r, "lease") {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: "lease 格式错误，例如 5m 或者 300(秒)",
+			Data:    "",
+		})
+		return
+	}
+	lease, err := target.Renew(r.URL.Query().Get("id"), queryDuration(r, "lease"))
+	if err != nil {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: err.Error(),
+			Data:    "",
+		})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(Response{
+		Code:    200,
+		Message: "续租成功",
+		Data:    lease,
+	})
+}
+
+func releaseHandler(w http.ResponseWriter, r *http.Request) {
+	err := target.Release(r.URL.Query().Get("id"), r.URL.Query().Get("outcome"))
+	if err != nil {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: err.Error(),
+			Data:    "",
+		})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(Response{
+		Code:    200,
+		Message: "归还成功",
+		Data:    "",
+	})
+}
+
+// 使用方，没有传 holder 用调用方的IP
+func holderOf(r *http.Request) string {
+	if holder := r.URL.Query().Get("holder"); holder != "" {
+		return holder
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// 时长参数的格式是否正确，没传也算正确
+func validDuration(r *http.Request, key string) bool {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return true
+	}
+	if _, err := time.ParseDuration(v); err == nil {
+		return true
+	}
+	_, err := strconv.ParseInt(v, 10, 64)
+	return err == nil
+}
+
+// 时长参数，支持 30s 5m 这种格式，纯数字按秒处理，没传返回 0
+func queryDuration(r *http.Request, key string) time.Duration {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return time.Duration(gt.Any2Int64(v)) * time.Second
+	}
+	return d
+}
@@ -0,0 +1,106 @@
+package serve
+
+import (
+	"FreeProxyMange/pool"
+	"FreeProxyMange/target"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// 放进池子并改成可用，放入未使用
+func putProxy(t *testing.T, ip *pool.ProxyIP) {
+	t.Helper()
+	ip.State = pool.StateValidating
+	if err := pool.BadgerUpsertStruct(pool.DBPath(ip.IP), ip.IP, ip); err != nil {
+		t.Fatal(err)
+	}
+	p, err := pool.SetState(ip.IP, pool.StateAvailable, "测试")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target.NotUsed.Store(p)
+}
+
+func call(t *testing.T, handler http.HandlerFunc, path string, data any) Response {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", path, nil))
+	resp := Response{Data: data}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Errorf("%s: %v", path, err)
+	}
+	return resp
+}
+
+// 通过 /get 并发分配、等待、批量分配和 /release 归还，同一个ip不能同时分给两个人
+func TestGetConcurrentNoDoubleLease(t *testing.T) {
+	useConf(t, "")
+	const n = 30
+	for i := 0; i < n; i++ {
+		putProxy(t, &pool.ProxyIP{IP: fmt.Sprintf("10.9.%d.%d:80", i/10, i%10), Score: float64(i % 7)})
+	}
+
+	var lock sync.Mutex
+	held := make(map[string]string) // ip -> 租约 ID
+	take := func(r GetResult) {
+		lock.Lock()
+		defer lock.Unlock()
+		if id, ok := held[r.Lease.IP]; ok {
+			t.Errorf("%s 同时分给了 %s 和 %s", r.Lease.IP, id, r.Lease.ID)
+		}
+		held[r.Lease.IP] = r.Lease.ID
+	}
+	giveBack := func(r GetResult) {
+		// 先去掉标记再归还，归还后别人马上就能分到
+		lock.Lock()
+		delete(held, r.Lease.IP)
+		lock.Unlock()
+		if resp := call(t, releaseHandler, "/release?id="+r.Lease.ID, nil); resp.Message != "归还成功" {
+			t.Errorf("归还 %s: %s", r.Lease.IP, resp.Message)
+		}
+	}
+
+	paths := []string{
+		"/get?holder=plain",
+		"/get?holder=wait&wait=200ms",
+		"/get?holder=rr&strategy=round-robin&wait=200ms",
+		"/get?holder=lru&strategy=lru",
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 12; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 30; i++ {
+				if g%4 == 3 {
+					batch := &BatchResult{}
+					call(t, getHandler, "/get?holder=batch&count=3&mode=best", batch)
+					for _, r := range batch.Proxies {
+						take(r)
+					}
+					for _, r := range batch.Proxies {
+						giveBack(r)
+					}
+					continue
+				}
+				r := &GetResult{}
+				if resp := call(t, getHandler, paths[(g+i)%len(paths)], r); resp.Code != 200 {
+					continue
+				}
+				take(*r)
+				giveBack(*r)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if got := target.NotUsed.Len(); got != n {
+		t.Fatalf("全部归还后未使用有 %d 个, 期望 %d", got, n)
+	}
+	if total := target.ShowUse(1).Total; total != 0 {
+		t.Fatalf("全部归还后还有 %d 个租约", total)
+	}
+}
@@ -0,0 +1,74 @@
+package serve
+
+import (
+	"FreeProxyMange/target"
+	"encoding/json"
+	"net/http"
+)
+
+/*
+
+粘性会话接口:
+/get?session=名称              同一个会话返回同一个代理，原来的不能用了自动换绑，返回 rebind=true
+                               其他筛选参数只在第一次绑定和换绑时生效，租约时长固定为 sessionTTL
+/sessions                      所有会话
+/sessionDelete?key=名称        删除会话并归还代理
+
+*/
+
+func getSession(w http.ResponseWriter, r *http.Request, filter *target.Filter, strategy target.Strategy, holder, protocol string) {
+	key := r.URL.Query().Get("session")
+	if key == "" {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: "session 不能为空",
+			Data:    "",
+		})
+		return
+	}
+	ip, lease, session, rebind := target.StickyIP(key, filter, strategy, holder)
+	if ip == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    404,
+			Message: "没有符合条件的代理",
+			Data:    "",
+		})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(Response{
+		Code:    200,
+		Message: "",
+		Data: GetResult{
+			Proxy:   ip.ProxyUrlFor(protocol),
+			Lease:   lease,
+			IP:      ip,
+			Session: session,
+			Rebind:  rebind,
+		},
+	})
+}
+
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(Response{
+		Code:    200,
+		Message: "",
+		Data:    target.ListSessions(),
+	})
+}
+
+func sessionDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if err := target.DeleteSession(r.URL.Query().Get("key")); err != nil {
+		_ = json.NewEncoder(w).Encode(Response{
+			Code:    200,
+			Message: err.Error(),
+			Data:    "",
+		})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(Response{
+		Code:    200,
+		Message: "删除成功",
+		Data:    "",
+	})
+}
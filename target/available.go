@@ -0,0 +1,354 @@
+package target
+
+import (
+	"FreeProxyMange/pool"
+	"container/heap"
+	"strings"
+	"sync"
+)
+
+/*
+
+未使用的ip:
+按分数建最大堆，全部一个，每个协议一个，每个出口国家一个，增删都是 O(log n)
+1. 分配时按筛选条件选最窄的堆，按分数从高到低逐个判断，不用每次把所有未使用的ip筛一遍
+2. score 策略取到第一个符合条件的就停，批量分配按分数收集前 candidateLimit 个候选，也不遍历整个堆
+   其他策略用 match 收集所有符合条件的ip，不排序
+3. 读写都在一把锁下，同一个ip只会被 LoadAndDelete 拿走一次
+
+*/
+
+type heapElem struct {
+	ip  *pool.ProxyIP
+	idx int
+}
+
+// 分数高的在前，相同按ip排，顺序固定
+type scoreHeap []*heapElem
+
+func (h scoreHeap) Len() int { return len(h) }
+
+func (h scoreHeap) Less(i, j int) bool {
+	if h[i].ip.Score != h[j].ip.Score {
+		return h[i].ip.Score > h[j].ip.Score
+	}
+	return h[i].ip.IP < h[j].ip.IP
+}
+
+func (h scoreHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].idx = i
+	h[j].idx = j
+}
+
+func (h *scoreHeap) Push(x any) {
+	e := x.(*heapElem)
+	e.idx = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *scoreHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// 一个ip在各个堆里的位置
+type availItem struct {
+	ip    *pool.ProxyIP
+	elems map[*scoreHeap]*heapElem
+}
+
+type availablePool struct {
+	lock       sync.RWMutex
+	items      map[string]*availItem
+	all        *scoreHeap
+	byProtocol map[string]*scoreHeap
+	byCountry  map[string]*scoreHeap
+}
+
+func newAvailablePool() *availablePool {
+	return &availablePool{
+		items:      make(map[string]*availItem),
+		all:        &scoreHeap{},
+		byProtocol: make(map[string]*scoreHeap),
+		byCountry:  make(map[string]*scoreHeap),
+	}
+}
+
+var allProtocols = []string{pool.ProtocolHttp, pool.ProtocolHttps, pool.ProtocolSocks4, pool.ProtocolSocks4a, pool.ProtocolSocks5}
+
+// 这个ip要放进哪些堆
+func (a *availablePool) heapsOf(ip *pool.ProxyIP) []*scoreHeap {
+	heaps := []*scoreHeap{a.all}
+	for _, protocol := range allProtocols {
+		if ip.Supports(protocol) {
+			heaps = append(heaps, subHeap(a.byProtocol, protocol))
+		}
+	}
+	if geo := ip.TargetGeo(); geo != nil && geo.Country != "" {
+		heaps = append(heaps, subHeap(a.byCountry, strings.ToUpper(geo.Country)))
+	}
+	return heaps
+}
+
+func subHeap(m map[string]*scoreHeap, key string) *scoreHeap {
+	h, ok := m[key]
+	if !ok {
+		h = &scoreHeap{}
+		m[key] = h
+	}
+	return h
+}
+
+// Store 放入或者更新
+func (a *availablePool) Store(ip *pool.ProxyIP) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.remove(ip.IP)
+	a.insert(ip)
+}
+
+// 调用方持有写锁
+func (a *availablePool) insert(ip *pool.ProxyIP) {
+	item := &availItem{ip: ip, elems: make(map[*scoreHeap]*heapElem)}
+	for _, h := range a.heapsOf(ip) {
+		e := &heapElem{ip: ip}
+		heap.Push(h, e)
+		item.elems[h] = e
+	}
+	a.items[ip.IP] = item
+}
+
+// Replace 已经在未使用里的换成新的记录，不在的不放入，返回是否替换了
+func (a *availablePool) Replace(ip *pool.ProxyIP) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.items[ip.IP]; !ok {
+		return false
+	}
+	a.remove(ip.IP)
+	a.insert(ip)
+	return true
+}
+
+func (a *availablePool) Load(ip string) (*pool.ProxyIP, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	item, ok := a.items[ip]
+	if !ok {
+		return nil, false
+	}
+	return item.ip, true
+}
+
+// LoadAndDelete 取出并删除，并发时只有一个能拿到
+func (a *availablePool) LoadAndDelete(ip string) (*pool.ProxyIP, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	item, ok := a.items[ip]
+	if !ok {
+		return nil, false
+	}
+	a.remove(ip)
+	return item.ip, true
+}
+
+func (a *availablePool) Delete(ip string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.remove(ip)
+}
+
+// 调用方持有写锁
+func (a *availablePool) remove(ip string) {
+	item, ok := a.items[ip]
+	if !ok {
+		return
+	}
+	for h, e := range item.elems {
+		heap.Remove(h, e.idx)
+	}
+	delete(a.items, ip)
+}
+
+func (a *availablePool) Len() int {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return len(a.items)
+}
+
+// 筛选条件对应的最窄的堆，指定了国家按国家，其次按协议，都没有用全部
+func (a *availablePool) heapsFor(filter *Filter) []*scoreHeap {
+	if len(filter.Countries) > 0 {
+		heaps := make([]*scoreHeap, 0, len(filter.Countries))
+		for _, country := range filter.Countries {
+			if h, ok := a.byCountry[strings.ToUpper(country)]; ok {
+				heaps = append(heaps, h)
+			}
+		}
+		return heaps
+	}
+	if filter.Type != "" {
+		if h, ok := a.byProtocol[filter.Type]; ok {
+			return []*scoreHeap{h}
+		}
+		return nil
+	}
+	return []*scoreHeap{a.all}
+}
+
+// 遍历时待访问的堆节点
+type walkNode struct {
+	h   *scoreHeap
+	idx int
+}
+
+type walkQueue []walkNode
+
+func (q walkQueue) Len() int { return len(q) }
+
+func (q walkQueue) Less(i, j int) bool {
+	a, b := (*q[i].h)[q[i].idx].ip, (*q[j].h)[q[j].idx].ip
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	return a.IP < b.IP
+}
+
+func (q walkQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *walkQueue) Push(x any) { *q = append(*q, x.(walkNode)) }
+
+func (q *walkQueue) Pop() any {
+	old := *q
+	n := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return n
+}
+
+// walk 按分数从高到低访问几个堆里的ip，fn 返回 false 停止，只访问到停止为止的那部分
+// 调用方持有读锁
+func walk(heaps []*scoreHeap, fn func(ip *pool.ProxyIP) bool) {
+	q := &walkQueue{}
+	for _, h := range heaps {
+		if h.Len() > 0 {
+			heap.Push(q, walkNode{h: h, idx: 0})
+		}
+	}
+	for q.Len() > 0 {
+		n := heap.Pop(q).(walkNode)
+		if !fn((*n.h)[n.idx].ip) {
+			return
+		}
+		for _, child := range []int{2*n.idx + 1, 2*n.idx + 2} {
+			if child < n.h.Len() {
+				heap.Push(q, walkNode{h: n.h, idx: child})
+			}
+		}
+	}
+}
+
+// find 按分数从高到低找符合筛选条件、出口没有被占用的ip，limit 为 0 不限制数量
+func (a *availablePool) find(filter *Filter, limit int) []*pool.ProxyIP {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	list := make([]*pool.ProxyIP, 0)
+	walk(a.heapsFor(filter), func(ip *pool.ProxyIP) bool {
+		if !allocatable(ip, filter) {
+			return true
+		}
+		list = append(list, ip)
+		return limit <= 0 || len(list) < limit
+	})
+	return list
+}
+
+// match 所有符合筛选条件、出口没有被占用的ip，不按分数排序，比 find 少了堆的遍历
+func (a *availablePool) match(filter *Filter) []*pool.ProxyIP {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	list := make([]*pool.ProxyIP, 0)
+	for _, h := range a.heapsFor(filter) {
+		for _, e := range *h {
+			if allocatable(e.ip, filter) {
+				list = append(list, e.ip)
+			}
+		}
+	}
+	return list
+}
+
+func allocatable(ip *pool.ProxyIP, filter *Filter) bool {
+	if _, busy := allocating.Load(ip.IP); busy {
+		return false
+	}
+	return filter.Match(ip) && !exitInUse(ip.ExitKey())
+}
+
+// Sorted 所有未使用的ip，按分数从高到低
+func (a *availablePool) Sorted() []*pool.ProxyIP {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	list := make([]*pool.ProxyIP, 0, len(a.items))
+	walk([]*scoreHeap{a.all}, func(ip *pool.ProxyIP) bool {
+		list = append(list, ip)
+		return true
+	})
+	return list
+}
+
+// ================ 已分配的出口和网段 ================
+
+// 已分配的ip按出口IP和 /24 网段计数，分配时不用遍历所有租约
+var (
+	leasedExits     = make(map[string]int)
+	leasedSubnets   = make(map[string]int)
+	leasedCountLock sync.RWMutex
+)
+
+func countLeased(exit, subnet string, n int) {
+	leasedCountLock.Lock()
+	defer leasedCountLock.Unlock()
+	addCount(leasedExits, exit, n)
+	addCount(leasedSubnets, subnet, n)
+}
+
+func addCount(m map[string]int, key string, n int) {
+	if key == "" {
+		return
+	}
+	m[key] += n
+	if m[key] <= 0 {
+		delete(m, key)
+	}
+}
+
+// 这个出口是否已经分配出去了
+func exitInUse(exit string) bool {
+	if exit == "" {
+		return false
+	}
+	leasedCountLock.RLock()
+	defer leasedCountLock.RUnlock()
+	return leasedExits[exit] > 0
+}
+
+// 这个网段当前的租约数
+func leasedInSubnet(subnet string) int {
+	leasedCountLock.RLock()
+	defer leasedCountLock.RUnlock()
+	return leasedSubnets[subnet]
+}
+
+// ShowNotUse 所有未使用的ip，按分数从高到低
+func ShowNotUse() []string {
+	list := NotUsed.Sorted()
+	ips := make([]string, 0, len(list))
+	for _, ip := range list {
+		ips = append(ips, ip.IP)
+	}
+	return ips
+}
@@ -0,0 +1,153 @@
+package target
+
+import (
+	"FreeProxyMange/pool"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+)
+
+// Replace 只替换还在未使用里的，已经被取走的不放回去
+func TestAvailableReplace(t *testing.T) {
+	a := newAvailablePool()
+	a.Store(&pool.ProxyIP{IP: "10.0.0.1:80", Score: 10})
+	if !a.Replace(&pool.ProxyIP{IP: "10.0.0.1:80", Score: 90}) {
+		t.Fatal("在未使用里的应该替换")
+	}
+	if ip, _ := a.Load("10.0.0.1:80"); ip.Score != 90 {
+		t.Fatalf("替换后分数 = %v", ip.Score)
+	}
+	if a.Replace(&pool.ProxyIP{IP: "10.0.0.2:80"}) {
+		t.Fatal("不在未使用里的不能放入")
+	}
+	a.LoadAndDelete("10.0.0.1:80")
+	if a.Replace(&pool.ProxyIP{IP: "10.0.0.1:80"}) || a.Len() != 0 {
+		t.Fatal("已经取走的不能放回去")
+	}
+}
+
+// 并发分配、批量分配和归还，同一个ip不能同时分给两个人
+func TestConcurrentUseNoDoubleLease(t *testing.T) {
+	resetAlloc(t)
+	const n = 200
+	for i := 0; i < n; i++ {
+		ip := &pool.ProxyIP{IP: fmt.Sprintf("10.3.%d.%d:80", i/50, i%50), Score: float64(i % 37)}
+		putAvailable(t, ip)
+		putNotUsed(ip)
+	}
+
+	var lock sync.Mutex
+	held := make(map[string]string) // ip -> 租约 ID
+	take := func(ip *pool.ProxyIP, lease *pool.Lease) {
+		lock.Lock()
+		defer lock.Unlock()
+		if id, ok := held[ip.IP]; ok {
+			t.Errorf("%s 同时分给了 %s 和 %s", ip.IP, id, lease.ID)
+		}
+		held[ip.IP] = lease.ID
+	}
+	giveBack := func(ip *pool.ProxyIP, lease *pool.Lease) {
+		// 先去掉标记再归还，归还后别人马上就能分到
+		lock.Lock()
+		delete(held, ip.IP)
+		lock.Unlock()
+		if endLease(ip.IP, lease.ID) {
+			release(ip.IP, OutcomeSuccess, "测试归还")
+		}
+	}
+
+	var wg sync.WaitGroup
+	strategies := []Strategy{score{}, &roundRobin{}, lru{}, leastLeased{}}
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			strategy := strategies[g%len(strategies)]
+			for i := 0; i < 100; i++ {
+				if g%4 == 3 {
+					list := UseIPs(&Filter{}, strategy, "batch", 0, 3, Distinct{}, false)
+					for _, a := range list {
+						take(a.IP, a.Lease)
+					}
+					for _, a := range list {
+						giveBack(a.IP, a.Lease)
+					}
+					continue
+				}
+				ip, lease := UseIP(&Filter{}, strategy, "single", 0)
+				if ip == nil {
+					continue
+				}
+				take(ip, lease)
+				giveBack(ip, lease)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if got := NotUsed.Len(); got != n {
+		t.Fatalf("全部归还后未使用有 %d 个, 期望 %d", got, n)
+	}
+	if got := usedCount.Load(); got != 0 {
+		t.Fatalf("全部归还后还有 %d 个租约", got)
+	}
+}
+
+// 共用同一个出口的ip同时只分配一个，归还后另一个才能分出去
+func TestUseIPSkipsSameExit(t *testing.T) {
+	resetAlloc(t)
+	a := &pool.ProxyIP{IP: "10.6.0.1:80", Score: 90, ExitIP: "203.0.113.50"}
+	b := &pool.ProxyIP{IP: "10.6.0.2:80", Score: 80, ExitIP: "203.0.113.50"}
+	for _, ip := range []*pool.ProxyIP{a, b} {
+		ip.RecordExit()
+		putAvailable(t, ip)
+		putNotUsed(ip)
+	}
+
+	first, lease := UseIP(&Filter{}, score{}, "t", 0)
+	if first == nil || first.IP != a.IP {
+		t.Fatalf("第一次分到 %v", first)
+	}
+	for _, strategy := range []Strategy{score{}, &roundRobin{}, lru{}} {
+		if ip, _ := UseIP(&Filter{}, strategy, "t", 0); ip != nil {
+			t.Fatalf("%s: 出口已经分配出去了还分到了 %s", strategy.Name(), ip.IP)
+		}
+	}
+
+	if endLease(first.IP, lease.ID) {
+		release(first.IP, OutcomeSuccess, "测试归还")
+	}
+	NotUsed.Delete(a.IP)
+	if ip, _ := UseIP(&Filter{}, score{}, "t", 0); ip == nil || ip.IP != b.IP {
+		t.Fatalf("归还后分到 %v", ip)
+	}
+}
+
+// 10 万个未使用的ip里分配再归还
+func BenchmarkUseIP(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	resetAlloc(b)
+	const n = 100000
+	for i := 0; i < n; i++ {
+		ip := &pool.ProxyIP{IP: fmt.Sprintf("10.%d.%d.%d:80", 100+i/65536, i/256%256, i%256), Score: float64(i % 1000)}
+		putAvailable(b, ip)
+		NotUsed.Store(ip)
+	}
+	for _, strategy := range []Strategy{score{}, &roundRobin{}} {
+		b.Run(strategy.Name(), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ip, lease := UseIP(&Filter{}, strategy, "bench", 0)
+				if ip == nil {
+					b.Fatal("没有分到ip")
+				}
+				if endLease(ip.IP, lease.ID) {
+					release(ip.IP, OutcomeSuccess, "测试归还")
+				}
+			}
+		})
+	}
+}
@@ -1,8 +1,10 @@
 package target
 
 import (
+	"FreeProxyMange/conf"
 	"FreeProxyMange/pool"
 	"context"
+	"net"
 	"sync"
 	"time"
 
@@ -12,110 +14,215 @@ import (
 func Run(ctx context.Context, wg *sync.WaitGroup) {
 	go func(ctx context.Context, wg *sync.WaitGroup) {
 		defer wg.Done()
-		NotUsedTask()
-		UsedTask()
-		NotUsedTask2()
+		pool.AddCheckHook(onChecked)
+		if !pool.WaitReady(ctx) {
+			return
+		}
+		restore()
+		restoreSessions()
+		go runWaiters(ctx)
+		go runDomainPrune(ctx)
+		<-ctx.Done()
+		stopSessions()
+		stopLeases()
 	}(ctx, wg)
 }
 
-var NotUsed sync.Map
-var Used sync.Map
+var NotUsed = newAvailablePool()
 
-func UsedTask() {
-	go func() {
-		for {
-			time.Sleep(4 * time.Second)
-			Used.Range(func(key, value any) bool {
-				time.Sleep(1 * time.Second)
-				now := time.Now().Unix()
-				if value.(int64) < now-60*2 {
-					NotUsed.Store(key, now)
-					Used.Delete(key)
-				}
-				return true
-			})
+// 检查调度器每检查完一个ip回调，状态为可用的放入未使用，其他的移出
+// 已分配的ip被隔离或死亡时租约作废，回调在ip锁内，ip.State 就是池子里最新的状态
+func onChecked(ip *pool.ProxyIP, err error) {
+	if ip.State != pool.StateLeased {
+		dropLease(ip.IP)
+	}
+	if ip.State != pool.StateAvailable {
+		NotUsed.Delete(ip.IP)
+		return
+	}
+	gt.Info("池子里找到可用ip ", ip.IP)
+	putNotUsed(ip)
+}
+
+// Filter 分配ip时的筛选条件，空值表示不限制
+type Filter struct {
+	Type      string   // 支持该协议 http https socks4 socks4a socks5
+	MaxMs     int64    // 最后一次检查的响应时间不超过该值
+	Exclude   []string // 不要这些ip，可以是 ip:port、ip 或出口IP
+	Domain    string   // 要访问的域名，在该域名上被禁用或者还没冷却的不分配
+	Anonymity string   // 匿名度不低于该级别
+	Site      string   // 该网站验证通过
+	Countries []string // 出口国家是其中之一
+	ASNs      []uint   // 出口 ASN 是其中之一
+	MinKbps   int64    // 带宽测试的下载速度不低于该值
+	Insecure  bool     // 允许分配拦截 TLS 或篡改内容的ip，默认不分配
+}
 
+func (f *Filter) Match(ip *pool.ProxyIP) bool {
+	if f.Type != "" && !ip.Supports(f.Type) {
+		return false
+	}
+	if f.MaxMs > 0 && (ip.Ms <= 0 || ip.Ms > f.MaxMs) {
+		return false
+	}
+	if f.excluded(ip) {
+		return false
+	}
+	if ip.DomainBanned(f.Domain) || !DomainFresh(ip, f.Domain) {
+		return false
+	}
+	if !f.Insecure && ip.Insecure() {
+		return false
+	}
+	if f.MinKbps > 0 && ip.Kbps < f.MinKbps {
+		return false
+	}
+	if !ip.GeoMatch(f.Countries, f.ASNs) {
+		return false
+	}
+	if !pool.AnonymityAtLeast(ip.Anonymity, f.Anonymity) {
+		return false
+	}
+	if f.Site != "" && !ip.SiteOK(f.Site) {
+		return false
+	}
+	return true
+}
+
+func (f *Filter) excluded(ip *pool.ProxyIP) bool {
+	if len(f.Exclude) == 0 {
+		return false
+	}
+	host := ip.Addr()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, v := range f.Exclude {
+		if v == ip.IP || v == ip.Addr() || v == host || v == ip.ExitIP {
+			return true
 		}
-	}()
+	}
+	return false
 }
 
-func NotUsedTask() {
-	go func() {
-		for {
-			time.Sleep(1 * time.Second)
-			for _, p := range pool.AllDBPath() {
-				ips, err := pool.BadgerGetAllKeys(p)
-				if err != nil {
-					gt.Error(err)
-				}
-				gt.Info("ips = ", ips)
-				for _, v := range ips {
-					time.Sleep(1 * time.Second)
-					go func() {
-						gt.Info("从池子里找可用ip ", v)
-						_, err := pool.CheckMs(v)
-						if err == nil {
-							now := time.Now().Unix()
-							NotUsed.Store(v, now)
-						}
-					}()
-
-				}
-			}
+// 分配时加锁，只在锁里选ip并占住，改状态、写租约这些读写库的操作在锁外做
+// 批量分配要么一起拿到要么都不拿，不能和别的分配交错
+var allocLock sync.Mutex
+
+// 正在分配的ip，已经从未使用取出还没有记录租约，选ip时跳过
+// 占住期间出口和网段先按已分配计数，别的分配不会选到同一个出口
+var allocating sync.Map
+
+// UseIP 按分配策略从符合筛选条件的未使用ip里取一个并生成租约，没有可用的返回 nil
+// 和已分配的ip共用同一个出口的不分配，在目标看来它们是同一个代理
+func UseIP(filter *Filter, strategy Strategy, holder string, d time.Duration) (*pool.ProxyIP, *pool.Lease) {
+	for {
+		ip := pickIP(filter, strategy)
+		if ip == nil {
+			return nil, nil
 		}
-	}()
+		if leased, lease, ok := leaseIP(ip, holder, d); ok {
+			recordDomainUse(leased, filter.Domain)
+			return leased, lease
+		}
+	}
 }
 
-func NotUsedTask2() {
-	go func() {
+// pickIP 选一个ip并占住，没有可用的返回 nil
+func pickIP(filter *Filter, strategy Strategy) *pool.ProxyIP {
+	allocLock.Lock()
+	defer allocLock.Unlock()
+	// 按分数选的直接取堆里第一个符合条件的
+	if _, ok := strategy.(score); ok {
 		for {
-			time.Sleep(4 * time.Second)
-			NotUsed.Range(func(key, value any) bool {
-				item := 0
-			R:
-				if item > 4 {
-					NotUsed.Delete(key.(string))
-					return true
-				}
-				time.Sleep(1 * time.Second)
-				_, err := pool.CheckMs(key.(string))
-				if err != nil {
-					item++
-					goto R
-				}
-
-				return true
-			})
+			list := NotUsed.find(filter, 1)
+			if len(list) == 0 {
+				return nil
+			}
+			if reserve(list[0]) {
+				return list[0]
+			}
+		}
+	}
+	candidates := Candidates(filter, strategy, 1)
+	for len(candidates) > 0 {
+		ip := strategy.Pick(candidates)
+		candidates = removeCandidate(candidates, ip)
+		if reserve(ip) {
+			return ip
 		}
-	}()
+	}
+	return nil
 }
 
-func UseIP() string {
-	ip := ""
-	NotUsed.Range(func(key, value any) bool {
-		ip = key.(string)
-		now := time.Now().Unix()
-		Used.Store(key.(string), now)
-		NotUsed.Delete(key.(string))
+// reserve 把选中的ip从未使用取出并占住，被别的地方先拿走了返回 false，调用方持有 allocLock
+func reserve(ip *pool.ProxyIP) bool {
+	if _, busy := allocating.Load(ip.IP); busy {
 		return false
-	})
-	return ip
+	}
+	if _, ok := NotUsed.LoadAndDelete(ip.IP); !ok {
+		return false
+	}
+	allocating.Store(ip.IP, struct{}{})
+	countLeased(ip.ExitKey(), pool.Subnet(ip.IP), 1)
+	return true
+}
+
+// unreserve 租约已经记录或者分配失败，去掉占用
+func unreserve(ip *pool.ProxyIP) {
+	countLeased(ip.ExitKey(), pool.Subnet(ip.IP), -1)
+	allocating.Delete(ip.IP)
+}
+
+// cancelReserve 占住的ip不分配了，池子里还是可用的放回未使用
+func cancelReserve(ip *pool.ProxyIP) {
+	unreserve(ip)
+	p, ok, err := pool.Get(ip.IP)
+	if err != nil {
+		gt.Error(err)
+		return
+	}
+	if ok && p.State == pool.StateAvailable {
+		putNotUsed(p)
+	}
+}
+
+// leaseIP 把占住的ip改成已分配并生成租约，池子里已经不是可用了返回 false
+func leaseIP(ip *pool.ProxyIP, holder string, d time.Duration) (*pool.ProxyIP, *pool.Lease, bool) {
+	defer unreserve(ip)
+	leased, err := pool.SetState(ip.IP, pool.StateLeased, "分配给 "+holder)
+	if err != nil {
+		gt.Error(err)
+		return nil, nil, false
+	}
+	// 取出后到改状态之间检查回调可能又按可用放了回来，占住期间别的分配选不到它，这里删掉不会误删别人的
+	NotUsed.Delete(ip.IP)
+	recordUse(ip.IP)
+	return leased, startLease(leased, holder, d), true
 }
 
-func ShowUse() []string {
-	rse := make([]string, 0)
-	Used.Range(func(key, value any) bool {
-		rse = append(rse, key.(string))
-		return true
-	})
-	return rse
+// Candidates 符合筛选条件、出口没有被占用的未使用ip
+// score 只要分数靠前的，按分数取前 candidateLimit(默认 200) 个，至少 n 个，不用遍历整个堆；
+// 其他策略在所有符合条件的ip里挑，不排序
+func Candidates(filter *Filter, strategy Strategy, n int) []*pool.ProxyIP {
+	if _, ok := strategy.(score); !ok {
+		return NotUsed.match(filter)
+	}
+	limit := conf.Int("candidateLimit", 200)
+	if limit <= 0 {
+		return NotUsed.find(filter, 0)
+	}
+	if limit < n {
+		limit = n
+	}
+	return NotUsed.find(filter, limit)
 }
 
-func ShowNotUse() []string {
-	rse := make([]string, 0)
-	NotUsed.Range(func(key, value any) bool {
-		rse = append(rse, key.(string))
-		return true
-	})
-	return rse
+func removeCandidate(list []*pool.ProxyIP, ip *pool.ProxyIP) []*pool.ProxyIP {
+	for i, v := range list {
+		if v == ip {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
 }
@@ -0,0 +1,151 @@
+package target
+
+import (
+	"FreeProxyMange/pool"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+
+批量分配:
+一次分配 count 个不同的ip，在分配锁里一起选出来并占住，不会和别的请求交错，有请求在排队时排在它们后面
+1. Distinct 要求 /24 网段、ASN、国家互不相同，要求 ASN 或国家不同时没有地理信息的ip不参与
+2. 同一批里出口IP也不能相同
+3. AllOrNothing 不够 count 个时一个都不分配，否则有几个分配几个
+
+*/
+
+// Distinct 批量分配时要求互不相同的维度
+type Distinct struct {
+	Subnet  bool
+	ASN     bool
+	Country bool
+}
+
+// ParseDistinct 解析 subnet,asn,country 这种逗号分隔的写法，不认识的返回错误的那一项
+func ParseDistinct(list []string) (Distinct, string) {
+	d := Distinct{}
+	for _, v := range list {
+		switch strings.ToLower(v) {
+		case "subnet":
+			d.Subnet = true
+		case "asn":
+			d.ASN = true
+		case "country":
+			d.Country = true
+		default:
+			return d, v
+		}
+	}
+	return d, ""
+}
+
+// 一个ip在各维度上的取值，拿不到的维度返回 false
+func (d Distinct) keys(ip *pool.ProxyIP) ([]string, bool) {
+	keys := make([]string, 0, 4)
+	if exit := ip.ExitKey(); exit != "" {
+		keys = append(keys, "exit:"+exit)
+	}
+	if d.Subnet {
+		keys = append(keys, "subnet:"+pool.Subnet(ip.IP))
+	}
+	if d.ASN || d.Country {
+		geo := ip.TargetGeo()
+		if geo == nil {
+			return nil, false
+		}
+		if d.ASN {
+			if geo.ASN == 0 {
+				return nil, false
+			}
+			keys = append(keys, "asn:"+strconv.FormatUint(uint64(geo.ASN), 10))
+		}
+		if d.Country {
+			if geo.Country == "" {
+				return nil, false
+			}
+			keys = append(keys, "country:"+geo.Country)
+		}
+	}
+	return keys, true
+}
+
+// Allocation 分配到的一个ip和租约
+type Allocation struct {
+	IP    *pool.ProxyIP
+	Lease *pool.Lease
+}
+
+// UseIPs 批量分配 count 个ip，返回分配到的，AllOrNothing 不够时返回空
+// 有请求在排队时先给排队的分配，剩下的才给这一批
+func UseIPs(filter *Filter, strategy Strategy, holder string, d time.Duration, count int, distinct Distinct, allOrNothing bool) []Allocation {
+	var list []Allocation
+	afterWaiters(func() {
+		list = useIPs(filter, strategy, holder, d, count, distinct, allOrNothing)
+	})
+	return list
+}
+
+func useIPs(filter *Filter, strategy Strategy, holder string, d time.Duration, count int, distinct Distinct, allOrNothing bool) []Allocation {
+	chosen := chooseIPs(filter, strategy, count, distinct)
+	if allOrNothing && len(chosen) < count {
+		for _, ip := range chosen {
+			cancelReserve(ip)
+		}
+		return nil
+	}
+
+	list := make([]Allocation, 0, len(chosen))
+	for _, ip := range chosen {
+		leased, lease, ok := leaseIP(ip, holder, d)
+		if !ok {
+			continue
+		}
+		recordDomainUse(leased, filter.Domain)
+		list = append(list, Allocation{IP: leased, Lease: lease})
+	}
+	// 分配过程中有ip被检查改了状态，凑不够就全部退回
+	if allOrNothing && len(list) < count {
+		for _, a := range list {
+			if endLease(a.IP.IP, a.Lease.ID) {
+				release(a.IP.IP, OutcomeSuccess, "批量分配不足退回")
+			}
+		}
+		return nil
+	}
+	return list
+}
+
+// chooseIPs 选出一批互不冲突的并占住，最多 count 个
+func chooseIPs(filter *Filter, strategy Strategy, count int, distinct Distinct) []*pool.ProxyIP {
+	allocLock.Lock()
+	defer allocLock.Unlock()
+	// 要求互不相同时冲突的会跳过，多取一些
+	candidates := Candidates(filter, strategy, count*4)
+	taken := make(map[string]struct{})
+	chosen := make([]*pool.ProxyIP, 0, count)
+	for len(chosen) < count && len(candidates) > 0 {
+		ip := strategy.Pick(candidates)
+		candidates = removeCandidate(candidates, ip)
+		keys, ok := distinct.keys(ip)
+		if !ok || conflicts(taken, keys) || !reserve(ip) {
+			continue
+		}
+		for _, k := range keys {
+			taken[k] = struct{}{}
+		}
+		chosen = append(chosen, ip)
+	}
+	return chosen
+}
+
+func conflicts(taken map[string]struct{}, keys []string) bool {
+	for _, k := range keys {
+		if _, ok := taken[k]; ok {
+			return true
+		}
+	}
+	return false
+}
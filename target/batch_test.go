@@ -0,0 +1,132 @@
+package target
+
+import (
+	"FreeProxyMange/pool"
+	"reflect"
+	"testing"
+)
+
+// 放进池子和未使用
+func putBatch(t *testing.T, ips ...*pool.ProxyIP) {
+	t.Helper()
+	for _, ip := range ips {
+		putAvailable(t, ip)
+		putNotUsed(ip)
+	}
+}
+
+func allocatedIPs(list []Allocation) []string {
+	ips := make([]string, 0, len(list))
+	for _, a := range list {
+		ips = append(ips, a.IP.IP)
+	}
+	return ips
+}
+
+// 按分数选，冲突的跳过
+func TestUseIPsDistinct(t *testing.T) {
+	us100 := &pool.GeoInfo{Country: "US", ASN: 100}
+	cases := []struct {
+		name     string
+		distinct Distinct
+		count    int
+		all      bool
+		want     []string
+	}{
+		{"不要求不同", Distinct{}, 2, true, []string{"10.7.1.1:80", "10.7.1.2:80"}},
+		{"网段不同", Distinct{Subnet: true}, 2, true, []string{"10.7.1.1:80", "10.7.2.1:80"}},
+		{"ASN 不同", Distinct{ASN: true}, 2, true, []string{"10.7.1.1:80", "10.7.1.2:80"}},
+		{"国家不同", Distinct{Country: true}, 2, true, []string{"10.7.1.1:80", "10.7.2.1:80"}},
+		// 没有地理信息的不参与
+		{"网段不同取 4 个", Distinct{Subnet: true}, 4, false, []string{"10.7.1.1:80", "10.7.2.1:80", "10.7.3.1:80"}},
+		{"国家不同取 3 个", Distinct{Country: true}, 3, false, []string{"10.7.1.1:80", "10.7.2.1:80"}},
+		{"ASN 和国家都不同不够", Distinct{ASN: true, Country: true}, 2, true, nil},
+		{"ASN 和国家都不同有几个给几个", Distinct{ASN: true, Country: true}, 2, false, []string{"10.7.1.1:80"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resetAlloc(t)
+			putBatch(t,
+				&pool.ProxyIP{IP: "10.7.1.1:80", Score: 90, Geo: us100},
+				&pool.ProxyIP{IP: "10.7.1.2:80", Score: 80, Geo: &pool.GeoInfo{Country: "US", ASN: 200}},
+				&pool.ProxyIP{IP: "10.7.2.1:80", Score: 70, Geo: &pool.GeoInfo{Country: "CA", ASN: 100}},
+				&pool.ProxyIP{IP: "10.7.3.1:80", Score: 60},
+			)
+			got := allocatedIPs(UseIPs(&Filter{}, score{}, "batch", 0, c.count, c.distinct, c.all))
+			if len(got) == 0 && len(c.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("分到 %v, 期望 %v", got, c.want)
+			}
+		})
+	}
+}
+
+// 同一批里出口IP不能相同，已经分配出去的出口也不再分配
+func TestUseIPsExitDedup(t *testing.T) {
+	resetAlloc(t)
+	a := &pool.ProxyIP{IP: "10.7.4.1:80", Score: 90, ExitIP: "203.0.113.60"}
+	b := &pool.ProxyIP{IP: "10.7.5.1:80", Score: 85, ExitIP: "203.0.113.60"}
+	c := &pool.ProxyIP{IP: "10.7.6.1:80", Score: 50}
+	d := &pool.ProxyIP{IP: "10.7.6.2:80", Score: 40}
+	for _, ip := range []*pool.ProxyIP{a, b} {
+		ip.RecordExit()
+	}
+	putBatch(t, a, b, c, d)
+
+	got := allocatedIPs(UseIPs(&Filter{}, score{}, "batch", 0, 2, Distinct{}, true))
+	if !reflect.DeepEqual(got, []string{a.IP, c.IP}) {
+		t.Fatalf("分到 %v", got)
+	}
+	// a 的出口还在用，b 分不出去
+	got = allocatedIPs(UseIPs(&Filter{}, score{}, "batch", 0, 2, Distinct{}, false))
+	if !reflect.DeepEqual(got, []string{d.IP}) {
+		t.Fatalf("出口被占用时分到 %v", got)
+	}
+}
+
+// 要求全部分到时，分配过程中有一个失败，已经分出去的全部退回
+func TestUseIPsAllOrNothingRollback(t *testing.T) {
+	resetAlloc(t)
+	a := &pool.ProxyIP{IP: "10.7.8.1:80", Score: 90}
+	b := &pool.ProxyIP{IP: "10.7.8.2:80", Score: 80}
+	putBatch(t, a, b)
+
+	// 候选不够时一个都不分配，选中的放回未使用
+	if got := UseIPs(&Filter{}, score{}, "batch", 0, 3, Distinct{}, true); got != nil {
+		t.Fatalf("候选不够时分到 %v", allocatedIPs(got))
+	}
+	if NotUsed.Len() != 2 || usedCount.Load() != 0 {
+		t.Fatalf("候选不够时未使用 %d 个，租约 %d 个", NotUsed.Len(), usedCount.Load())
+	}
+
+	// 只在未使用里、池子里没有的改不了状态，分配时会失败，分数最低最后分配
+	NotUsed.Store(&pool.ProxyIP{IP: "10.7.8.3:80", Score: 10})
+	if got := UseIPs(&Filter{}, score{}, "batch", 0, 3, Distinct{}, true); got != nil {
+		t.Fatalf("分配失败时分到 %v", allocatedIPs(got))
+	}
+	for _, ip := range []*pool.ProxyIP{a, b} {
+		if _, ok := NotUsed.Load(ip.IP); !ok {
+			t.Fatalf("%s 没有退回未使用", ip.IP)
+		}
+		if _, ok := Used.Load(ip.IP); ok {
+			t.Fatalf("%s 的租约没有结束", ip.IP)
+		}
+		if s := stateOf(t, ip.IP); s != pool.StateAvailable {
+			t.Fatalf("%s 退回后状态 = %s", ip.IP, s)
+		}
+	}
+	if n := usedCount.Load(); n != 0 {
+		t.Fatalf("退回后还有 %d 个租约", n)
+	}
+	leases, err := pool.AllLeases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range leases {
+		if l.IP == a.IP || l.IP == b.IP {
+			t.Fatalf("库里还有租约 %+v", l)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package target
+
+import (
+	"FreeProxyMange/conf"
+	"FreeProxyMange/pool"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+按域名限制复用:
+目标网站按ip限频，同一个ip短时间内分给多个访问同一域名的任务容易被封
+1. /get?domain= 分配时记录出口在该域名上的使用，有出口IP的按出口IP记，多个代理同一个出口算一个
+2. 上次分配给该域名后冷却 cooldown(默认 domainCooldown 1m) 内不再分配
+3. window(默认 domainWindow 1h) 内最多分配 maxRequests(默认 domainMaxRequests，0 不限制) 次
+4. domainPolicy 按域名单独配置，子域名没配置时用上级域名的，例如 shop.example.com 用 example.com 的
+5. 粘性会话继续使用已绑定的ip不受限制，但会计入使用次数
+6. 每分钟清理一次过期的记录，不再分配的出口整个删掉
+
+*/
+
+// DomainPolicy 一个域名的复用限制
+type DomainPolicy struct {
+	Cooldown    time.Duration
+	MaxRequests int
+	Window      time.Duration
+}
+
+// GetDomainPolicy 域名的复用限制，没有单独配置的用默认值
+func GetDomainPolicy(domain string) DomainPolicy {
+	policy := DomainPolicy{
+		Cooldown:    conf.Duration("domainCooldown", time.Minute),
+		MaxRequests: conf.Int("domainMaxRequests", 0),
+		Window:      conf.Duration("domainWindow", time.Hour),
+	}
+	policies, ok := conf.Get("domainPolicy").(map[string]interface{})
+	if !ok {
+		return policy
+	}
+	for d := domain; d != ""; {
+		if v, ok := policies[d].(map[string]interface{}); ok {
+			if cooldown, ok := v["cooldown"].(string); ok {
+				if t, err := time.ParseDuration(cooldown); err == nil {
+					policy.Cooldown = t
+				}
+			}
+			if n, ok := v["maxRequests"].(int); ok {
+				policy.MaxRequests = n
+			}
+			if window, ok := v["window"].(string); ok {
+				if t, err := time.ParseDuration(window); err == nil {
+					policy.Window = t
+				}
+			}
+			return policy
+		}
+		i := strings.Index(d, ".")
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	return policy
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSpace(domain))
+}
+
+// 一个出口在一个域名上的分配时间，按时间顺序
+type domainUse struct {
+	times []int64 // UnixNano
+}
+
+var (
+	domainUses     = make(map[string]map[string]*domainUse) // 出口 -> 域名 -> 使用记录
+	domainUsesLock sync.Mutex
+)
+
+// 按出口记，没有出口IP或者出口会变的按代理本身记
+func domainUseKey(ip *pool.ProxyIP) string {
+	if exit := ip.ExitKey(); exit != "" {
+		return exit
+	}
+	return ip.IP
+}
+
+// DomainFresh 这个ip现在能不能分配给该域名
+func DomainFresh(ip *pool.ProxyIP, domain string) bool {
+	domain = normalizeDomain(domain)
+	if domain == "" {
+		return true
+	}
+	policy := GetDomainPolicy(domain)
+	domainUsesLock.Lock()
+	defer domainUsesLock.Unlock()
+	use, ok := domainUses[domainUseKey(ip)][domain]
+	if !ok || len(use.times) == 0 {
+		return true
+	}
+	return use.fresh(policy, time.Now().UnixNano())
+}
+
+// 冷却已过并且窗口内次数没有超限
+func (u *domainUse) fresh(policy DomainPolicy, now int64) bool {
+	if now-u.times[len(u.times)-1] < int64(policy.Cooldown) {
+		return false
+	}
+	return policy.MaxRequests <= 0 || u.count(now-int64(policy.Window)) < policy.MaxRequests
+}
+
+// 从 since 开始的使用次数
+func (u *domainUse) count(since int64) int {
+	i := sort.Search(len(u.times), func(i int) bool { return u.times[i] >= since })
+	return len(u.times) - i
+}
+
+// 清掉已经不影响判断的记录，keeps 缓存每个域名要保留多久
+func pruneUses(uses map[string]*domainUse, now int64, keeps map[string]int64) {
+	for d, use := range uses {
+		keep, ok := keeps[d]
+		if !ok {
+			policy := GetDomainPolicy(d)
+			keep = int64(policy.Window)
+			if int64(policy.Cooldown) > keep {
+				keep = int64(policy.Cooldown)
+			}
+			keeps[d] = keep
+		}
+		use.times = use.times[len(use.times)-use.count(now-keep):]
+		if len(use.times) == 0 {
+			delete(uses, d)
+		}
+	}
+}
+
+// pruneDomainUses 清掉所有出口上已经不影响判断的记录，不再分配的出口整个删掉
+func pruneDomainUses() {
+	now := time.Now().UnixNano()
+	keeps := make(map[string]int64)
+	domainUsesLock.Lock()
+	defer domainUsesLock.Unlock()
+	for key, uses := range domainUses {
+		pruneUses(uses, now, keeps)
+		if len(uses) == 0 {
+			delete(domainUses, key)
+		}
+	}
+}
+
+// runDomainPrune 每分钟清理一次，出口不再被分配时记录也不会一直留着
+func runDomainPrune(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pruneDomainUses()
+		}
+	}
+}
+
+// recordDomainUse 记录一次分配，顺便清掉这个出口上已经不影响判断的记录
+func recordDomainUse(ip *pool.ProxyIP, domain string) {
+	domain = normalizeDomain(domain)
+	if domain == "" {
+		return
+	}
+	key := domainUseKey(ip)
+	now := time.Now().UnixNano()
+	domainUsesLock.Lock()
+	defer domainUsesLock.Unlock()
+	uses, ok := domainUses[key]
+	if !ok {
+		uses = make(map[string]*domainUse)
+		domainUses[key] = uses
+	}
+	pruneUses(uses, now, make(map[string]int64))
+	use, ok := uses[domain]
+	if !ok {
+		use = &domainUse{}
+		uses[domain] = use
+	}
+	use.times = append(use.times, now)
+}
+
+// DomainUsage 一个出口在该域名上的使用情况
+type DomainUsage struct {
+	Key      string `json:"key"`      // 出口IP或代理
+	Last     int64  `json:"last"`     // 最后一次分配时间
+	Requests int    `json:"requests"` // 窗口内分配次数
+	Fresh    bool   `json:"fresh"`    // 现在能不能再分配
+}
+
+// DomainUsages 该域名上所有出口的使用情况，按最后分配时间倒序
+func DomainUsages(domain string) []DomainUsage {
+	domain = normalizeDomain(domain)
+	policy := GetDomainPolicy(domain)
+	now := time.Now().UnixNano()
+	domainUsesLock.Lock()
+	defer domainUsesLock.Unlock()
+	list := make([]DomainUsage, 0)
+	for key, uses := range domainUses {
+		use, ok := uses[domain]
+		if !ok || len(use.times) == 0 {
+			continue
+		}
+		last := use.times[len(use.times)-1]
+		requests := use.count(now - int64(policy.Window))
+		list = append(list, DomainUsage{
+			Key:      key,
+			Last:     last / int64(time.Second),
+			Requests: requests,
+			Fresh:    use.fresh(policy, now),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Last > list[j].Last })
+	return list
+}
@@ -0,0 +1,34 @@
+package target
+
+import (
+	"FreeProxyMange/pool"
+	"testing"
+	"time"
+)
+
+// 不再分配的出口，过了冷却和窗口记录要被清掉
+func TestPruneDomainUses(t *testing.T) {
+	useConf(t, "domainCooldown: 10ms\ndomainWindow: 50ms\ndomainPolicy:\n  slow.com: {window: 1h}\n")
+	t.Cleanup(func() {
+		domainUsesLock.Lock()
+		domainUses = make(map[string]map[string]*domainUse)
+		domainUsesLock.Unlock()
+	})
+	a := &pool.ProxyIP{IP: "10.0.0.1:80"}
+	b := &pool.ProxyIP{IP: "10.0.0.2:80"}
+	recordDomainUse(a, "example.com")
+	recordDomainUse(b, "example.com")
+	recordDomainUse(b, "slow.com")
+
+	time.Sleep(80 * time.Millisecond)
+	pruneDomainUses()
+
+	domainUsesLock.Lock()
+	defer domainUsesLock.Unlock()
+	if _, ok := domainUses[a.IP]; ok {
+		t.Fatal("过期的出口没有删掉")
+	}
+	if uses := domainUses[b.IP]; len(uses) != 1 || uses["slow.com"] == nil {
+		t.Fatalf("窗口内的记录不能删: %v", uses)
+	}
+}
@@ -0,0 +1,42 @@
+package target
+
+import (
+	"FreeProxyMange/pool"
+	"errors"
+)
+
+// Feedback 记录使用方反馈，按反馈后的状态更新未使用和租约
+func Feedback(fb *pool.Feedback) (*pool.ProxyIP, error) {
+	ip := ""
+	if fb.LeaseID != "" {
+		if lease, ok := GetLease(fb.LeaseID); ok {
+			ip = lease.IP
+		}
+	}
+	if ip == "" && fb.Proxy != "" {
+		p, err := pool.ParseProxy(fb.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		ip = p.IP
+	}
+	if ip == "" {
+		return nil, errors.New("proxy 和 leaseId 不能都为空")
+	}
+
+	p, err := pool.ApplyFeedback(ip, fb)
+	if err != nil {
+		return nil, err
+	}
+	switch p.State {
+	case pool.StateLeased:
+	case pool.StateAvailable:
+		// 未使用里存的是记录的副本，换成新的，域名禁用才能生效
+		// 已经被分配走的不能放回去，判断和替换在同一把锁下
+		NotUsed.Replace(p)
+	default:
+		dropLease(ip)
+		NotUsed.Delete(ip)
+	}
+	return p, nil
+}
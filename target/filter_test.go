@@ -0,0 +1,50 @@
+package target
+
+import (
+	"FreeProxyMange/pool"
+	"testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+	cases := []struct {
+		name   string
+		filter Filter
+		ip     pool.ProxyIP
+		want   bool
+	}{
+		{"不限制带宽", Filter{}, pool.ProxyIP{IP: "10.5.0.1:80"}, true},
+		{"带宽够", Filter{MinKbps: 1000}, pool.ProxyIP{IP: "10.5.0.1:80", Kbps: 1500}, true},
+		{"带宽不够", Filter{MinKbps: 1000}, pool.ProxyIP{IP: "10.5.0.1:80", Kbps: 800}, false},
+		{"没测过带宽", Filter{MinKbps: 1000}, pool.ProxyIP{IP: "10.5.0.1:80"}, false},
+		{"篡改内容默认不分配", Filter{}, pool.ProxyIP{IP: "10.5.0.1:80", Tampered: true}, false},
+		{"拦截TLS默认不分配", Filter{}, pool.ProxyIP{IP: "10.5.0.1:80", Intercepted: true}, false},
+		{"insecure=1 允许篡改", Filter{Insecure: true}, pool.ProxyIP{IP: "10.5.0.1:80", Tampered: true}, true},
+		{"insecure=1 允许拦截", Filter{Insecure: true}, pool.ProxyIP{IP: "10.5.0.1:80", Intercepted: true}, true},
+	}
+	for _, c := range cases {
+		if got := c.filter.Match(&c.ip); got != c.want {
+			t.Errorf("%s: Match = %v, 期望 %v", c.name, got, c.want)
+		}
+	}
+}
+
+// 检查通过的拦截篡改ip放进未使用，默认分不到，insecure=1 才分配
+func TestUseIPInsecure(t *testing.T) {
+	resetAlloc(t)
+	ip := &pool.ProxyIP{IP: "10.5.1.1:80", Score: 50, Tampered: true}
+	putAvailable(t, ip)
+	onChecked(ip, nil)
+	if _, ok := NotUsed.Load(ip.IP); !ok {
+		t.Fatal("检查通过的篡改ip应该放入未使用")
+	}
+	if got, _ := UseIP(&Filter{}, score{}, "t", 0); got != nil {
+		t.Fatalf("默认分到了篡改的 %s", got.IP)
+	}
+	if got, _ := UseIP(&Filter{}, &roundRobin{}, "t", 0); got != nil {
+		t.Fatalf("轮询分到了篡改的 %s", got.IP)
+	}
+	got, lease := UseIP(&Filter{Insecure: true}, score{}, "t", 0)
+	if got == nil || got.IP != ip.IP || lease == nil {
+		t.Fatalf("insecure=1 分到 %v", got)
+	}
+}
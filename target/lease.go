@@ -0,0 +1,322 @@
+package target
+
+import (
+	"FreeProxyMange/conf"
+	"FreeProxyMange/pool"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+租约:
+每次分配生成一个租约，有 ID、使用方、到期时间，存到 pool 的 ./lease，重启后恢复
+1. 分配时可以指定使用时长，默认 leaseTime(2m)，最长 leaseMaxTime(30m)
+2. 到期前可以续租，续租从当前时间重新计算到期时间
+3. 用完主动归还并带上结果:
+   success  代理正常，放回未使用
+   failed   代理不能用，进入冷却并马上安排检查
+   banned   代理被目标网站封了，隔离
+4. 每个租约一个定时器，到期准时按 success 归还
+5. /useList 返回分数最高的 limit 个租约(默认 100，最多 1000)，同时返回总数
+
+*/
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailed  = "failed"
+	OutcomeBanned  = "banned"
+)
+
+var (
+	ErrLeaseNotFound = errors.New("租约不存在或已到期")
+	ErrLeaseOutcome  = errors.New("outcome 只支持 success failed banned")
+)
+
+// 已分配的ip，ip -> *leaseEntry
+var Used sync.Map
+
+// 租约 ID -> ip
+var leaseIDs sync.Map
+
+// Used 里的租约数，列表只返回一部分时用来给出总数
+var usedCount atomic.Int64
+
+type leaseEntry struct {
+	lock  sync.Mutex
+	lease *pool.Lease
+	timer *time.Timer
+	exit  string // 分配时的出口IP，用于计数
+}
+
+// LeaseDuration 按配置修正请求的使用时长，0 用默认值，超过上限按上限
+func LeaseDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		d = conf.Duration("leaseTime", 2*time.Minute)
+	}
+	if max := conf.Duration("leaseMaxTime", 30*time.Minute); d > max {
+		d = max
+	}
+	return d
+}
+
+func newLeaseID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startLease 给刚分配的ip生成租约并开始计时
+func startLease(ip *pool.ProxyIP, holder string, d time.Duration) *pool.Lease {
+	now := time.Now()
+	lease := &pool.Lease{
+		ID:       newLeaseID(),
+		IP:       ip.IP,
+		Holder:   holder,
+		LeasedAt: now.Unix(),
+		ExpireAt: now.Add(LeaseDuration(d)).Unix(),
+	}
+	if err := pool.SaveLease(lease); err != nil {
+		gt.Error(err)
+	}
+	trackLease(lease)
+	return lease
+}
+
+// trackLease 记录租约并按到期时间设置定时器，这个ip已经有租约时替换掉
+func trackLease(lease *pool.Lease) {
+	entry := &leaseEntry{lease: lease, exit: pool.ExitOf(lease.IP)}
+	ip, id := lease.IP, lease.ID
+	entry.timer = time.AfterFunc(time.Until(time.Unix(lease.ExpireAt, 0)), func() {
+		if endLease(ip, id) {
+			release(ip, OutcomeSuccess, "租约到期归还")
+		}
+	})
+	if old, loaded := Used.Swap(ip, entry); loaded {
+		// 被替换的租约不再有效，停掉它的定时器，按旧 ID 也查不到了
+		prev := old.(*leaseEntry)
+		prev.lock.Lock()
+		prev.timer.Stop()
+		leaseIDs.Delete(prev.lease.ID)
+		prev.lock.Unlock()
+		countLeased(prev.exit, pool.Subnet(ip), -1)
+	} else {
+		usedCount.Add(1)
+	}
+	countLeased(entry.exit, pool.Subnet(ip), 1)
+	leaseIDs.Store(id, ip)
+}
+
+// endLease 结束租约，返回 false 表示租约已经被别的地方结束了
+func endLease(ip, id string) bool {
+	v, ok := Used.Load(ip)
+	if !ok {
+		return false
+	}
+	entry := v.(*leaseEntry)
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+	if entry.lease.ID != id || !Used.CompareAndDelete(ip, entry) {
+		return false
+	}
+	entry.timer.Stop()
+	usedCount.Add(-1)
+	countLeased(entry.exit, pool.Subnet(ip), -1)
+	leaseIDs.Delete(id)
+	if err := pool.DeleteLease(ip); err != nil {
+		gt.Error(err)
+	}
+	return true
+}
+
+// dropLease 池子里的ip已经不是已分配状态，租约作废
+func dropLease(ip string) {
+	if v, ok := Used.Load(ip); ok {
+		endLease(ip, v.(*leaseEntry).lease.ID)
+	}
+}
+
+// release 按使用结果修改池子里的状态，正常的放回未使用，分配期间被隔离或死亡的不再放回
+func release(ip, outcome, reason string) {
+	switch outcome {
+	case OutcomeFailed:
+		if _, err := pool.SetState(ip, pool.StateCooling, reason); err != nil {
+			gt.Error(err)
+			return
+		}
+		pool.CheckSoon(ip)
+	case OutcomeBanned:
+		if _, err := pool.SetState(ip, pool.StateQuarantined, reason); err != nil {
+			gt.Error(err)
+		}
+	default:
+		p, err := pool.SetState(ip, pool.StateAvailable, reason)
+		if err != nil {
+			gt.Error(err)
+			return
+		}
+		putNotUsed(p)
+	}
+}
+
+// GetLease 按 ID 查找租约
+func GetLease(id string) (*pool.Lease, bool) {
+	ip, ok := leaseIDs.Load(id)
+	if !ok {
+		return nil, false
+	}
+	v, ok := Used.Load(ip)
+	if !ok {
+		return nil, false
+	}
+	entry := v.(*leaseEntry)
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+	if entry.lease.ID != id {
+		return nil, false
+	}
+	lease := *entry.lease
+	return &lease, true
+}
+
+// Renew 续租，到期时间从现在开始重新计算
+func Renew(id string, d time.Duration) (*pool.Lease, error) {
+	ip, ok := leaseIDs.Load(id)
+	if !ok {
+		return nil, ErrLeaseNotFound
+	}
+	v, ok := Used.Load(ip)
+	if !ok {
+		return nil, ErrLeaseNotFound
+	}
+	entry := v.(*leaseEntry)
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+	if entry.lease.ID != id {
+		return nil, ErrLeaseNotFound
+	}
+	// 定时器已经触发说明正在归还
+	d = LeaseDuration(d)
+	if !entry.timer.Stop() {
+		return nil, ErrLeaseNotFound
+	}
+	entry.lease.ExpireAt = time.Now().Add(d).Unix()
+	entry.timer.Reset(d)
+	if err := pool.SaveLease(entry.lease); err != nil {
+		gt.Error(err)
+	}
+	lease := *entry.lease
+	return &lease, nil
+}
+
+// Release 主动归还租约
+func Release(id, outcome string) error {
+	if outcome == "" {
+		outcome = OutcomeSuccess
+	}
+	if outcome != OutcomeSuccess && outcome != OutcomeFailed && outcome != OutcomeBanned {
+		return ErrLeaseOutcome
+	}
+	ip, ok := leaseIDs.Load(id)
+	if !ok || !endLease(ip.(string), id) {
+		return ErrLeaseNotFound
+	}
+	release(ip.(string), outcome, "归还: "+outcome)
+	return nil
+}
+
+// restore 按池子里的状态和租约恢复未使用和已使用，重启后和池子保持一致
+// 池子里已分配但租约丢失或到期的归还，池子里不是已分配的租约删除
+func restore() {
+	for _, ip := range pool.ListByState(pool.StateAvailable) {
+		putNotUsed(ip)
+	}
+
+	leases, err := pool.AllLeases()
+	if err != nil {
+		gt.Error(err)
+	}
+	leaseMap := make(map[string]*pool.Lease, len(leases))
+	for _, l := range leases {
+		leaseMap[l.IP] = l
+	}
+
+	now := time.Now().Unix()
+	restored := 0
+	for _, ip := range pool.ListByState(pool.StateLeased) {
+		l, ok := leaseMap[ip.IP]
+		delete(leaseMap, ip.IP)
+		if !ok || l.ExpireAt < now {
+			if err := pool.DeleteLease(ip.IP); err != nil {
+				gt.Error(err)
+			}
+			release(ip.IP, OutcomeSuccess, "重启时租约已到期")
+			continue
+		}
+		if l.ID == "" {
+			l.ID = newLeaseID()
+			if err := pool.SaveLease(l); err != nil {
+				gt.Error(err)
+			}
+		}
+		trackLease(l)
+		restored++
+	}
+	for ip := range leaseMap {
+		if err := pool.DeleteLease(ip); err != nil {
+			gt.Error(err)
+		}
+	}
+	gt.Info("恢复已分配 ", restored, " 个，清理无效租约 ", len(leaseMap), " 个")
+}
+
+// stopLeases 程序退出时停掉所有定时器，租约保留在库里，重启后恢复
+func stopLeases() {
+	Used.Range(func(key, value any) bool {
+		entry := value.(*leaseEntry)
+		entry.lock.Lock()
+		entry.timer.Stop()
+		entry.lock.Unlock()
+		return true
+	})
+}
+
+// UseList 租约列表，租约很多时只返回一部分
+type UseList struct {
+	Total  int           `json:"total"` // 当前租约总数
+	Leases []*pool.Lease `json:"leases"`
+}
+
+// ShowUse 分数最高的 limit 个租约，先按分数给所有ip排序，只复制返回的那些租约
+func ShowUse(limit int) UseList {
+	ips := make([]string, 0, usedCount.Load())
+	Used.Range(func(key, _ any) bool {
+		ips = append(ips, key.(string))
+		return true
+	})
+	sort.Strings(ips)
+	pool.SortByScore(ips)
+	list := make([]*pool.Lease, 0, limit)
+	for _, ip := range ips {
+		if len(list) >= limit {
+			break
+		}
+		v, ok := Used.Load(ip)
+		if !ok {
+			continue
+		}
+		entry := v.(*leaseEntry)
+		entry.lock.Lock()
+		lease := *entry.lease
+		entry.lock.Unlock()
+		list = append(list, &lease)
+	}
+	return UseList{Total: int(usedCount.Load()), Leases: list}
+}
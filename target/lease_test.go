@@ -0,0 +1,179 @@
+package target
+
+import (
+	"FreeProxyMange/pool"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// 租约很多时只返回分数最高的 limit 个，总数照常
+func TestShowUseLimit(t *testing.T) {
+	resetAlloc(t)
+	for i := 0; i < 5; i++ {
+		// 第 i 个检查成功 i 次，分数依次升高
+		ip := &pool.ProxyIP{IP: fmt.Sprintf("10.4.0.%d:80", i+1)}
+		for j := 0; j < 5; j++ {
+			ip.History = append(ip.History, pool.CheckLog{OK: j < i})
+		}
+		ip.UpdateScore()
+		putAvailable(t, ip)
+		putNotUsed(ip)
+		if got, _ := UseIP(&Filter{}, &roundRobin{}, "show", 0); got == nil {
+			t.Fatal("没有分到ip")
+		}
+	}
+	list := ShowUse(3)
+	if list.Total != 5 || len(list.Leases) != 3 {
+		t.Fatalf("总数 = %d 返回 = %d", list.Total, len(list.Leases))
+	}
+	for i, want := range []string{"10.4.0.5:80", "10.4.0.4:80", "10.4.0.3:80"} {
+		if list.Leases[i].IP != want {
+			t.Fatalf("第 %d 个是 %s, 期望 %s", i+1, list.Leases[i].IP, want)
+		}
+	}
+	if list := ShowUse(10); len(list.Leases) != 5 {
+		t.Fatalf("返回 = %d", len(list.Leases))
+	}
+}
+
+// 分配一个ip，租约时长 d
+func leaseOne(t *testing.T, addr string, d time.Duration) *pool.Lease {
+	t.Helper()
+	ip := &pool.ProxyIP{IP: addr}
+	putAvailable(t, ip)
+	putNotUsed(ip)
+	got, lease := UseIP(&Filter{}, score{}, "lease", d)
+	if got == nil || got.IP != addr {
+		t.Fatalf("没有分到 %s: %v", addr, got)
+	}
+	return lease
+}
+
+func stateOf(t *testing.T, ip string) string {
+	t.Helper()
+	p, ok, err := pool.Get(ip)
+	if err != nil || !ok {
+		t.Fatalf("读取 %s: %v %v", ip, ok, err)
+	}
+	return p.State
+}
+
+// 等到 fn 返回 true，超时失败
+func waitUntil(t *testing.T, timeout time.Duration, fn func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatal("等待超时")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// 到期按 success 归还，放回未使用
+func TestLeaseExpire(t *testing.T) {
+	resetAlloc(t)
+	lease := leaseOne(t, "10.4.1.1:80", time.Second)
+	waitUntil(t, 3*time.Second, func() bool {
+		_, ok := NotUsed.Load(lease.IP)
+		return ok
+	})
+	if _, ok := GetLease(lease.ID); ok {
+		t.Fatal("到期后还能查到租约")
+	}
+	if s := stateOf(t, lease.IP); s != pool.StateAvailable {
+		t.Fatalf("到期归还后状态 = %s", s)
+	}
+	if _, err := Renew(lease.ID, time.Minute); err != ErrLeaseNotFound {
+		t.Fatalf("到期后续租: %v", err)
+	}
+}
+
+// 续租从现在开始重新计时，原来的到期时间不再归还
+func TestLeaseRenew(t *testing.T) {
+	resetAlloc(t)
+	lease := leaseOne(t, "10.4.2.1:80", time.Second)
+	renewed, err := Renew(lease.ID, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.ID != lease.ID || renewed.ExpireAt < time.Now().Add(50*time.Second).Unix() {
+		t.Fatalf("续租后 %+v", renewed)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if got, ok := GetLease(lease.ID); !ok || got.ExpireAt != renewed.ExpireAt {
+		t.Fatalf("续租后原来的到期时间归还了: %v %v", got, ok)
+	}
+	if s := stateOf(t, lease.IP); s != pool.StateLeased {
+		t.Fatalf("续租后状态 = %s", s)
+	}
+	if _, err := Renew("no-such-id", time.Minute); err != ErrLeaseNotFound {
+		t.Fatalf("不存在的租约续租: %v", err)
+	}
+}
+
+// 归还按结果改状态，同一个租约只能归还一次
+func TestLeaseRelease(t *testing.T) {
+	resetAlloc(t)
+	ok := leaseOne(t, "10.4.3.1:80", time.Minute)
+	failed := leaseOne(t, "10.4.3.2:80", time.Minute)
+	banned := leaseOne(t, "10.4.3.3:80", time.Minute)
+
+	if err := Release(ok.ID, "lost"); err != ErrLeaseOutcome {
+		t.Fatalf("不支持的结果: %v", err)
+	}
+	for _, c := range []struct {
+		lease   *pool.Lease
+		outcome string
+		state   string
+	}{
+		{ok, "", pool.StateAvailable},
+		{failed, OutcomeFailed, pool.StateCooling},
+		{banned, OutcomeBanned, pool.StateQuarantined},
+	} {
+		if err := Release(c.lease.ID, c.outcome); err != nil {
+			t.Fatal(err)
+		}
+		if s := stateOf(t, c.lease.IP); s != c.state {
+			t.Fatalf("%s 归还后状态 = %s, 期望 %s", c.outcome, s, c.state)
+		}
+		_, inNotUsed := NotUsed.Load(c.lease.IP)
+		if inNotUsed != (c.state == pool.StateAvailable) {
+			t.Fatalf("%s 归还后在未使用里 = %v", c.outcome, inNotUsed)
+		}
+		if err := Release(c.lease.ID, c.outcome); err != ErrLeaseNotFound {
+			t.Fatalf("重复归还: %v", err)
+		}
+	}
+	if n := usedCount.Load(); n != 0 {
+		t.Fatalf("全部归还后还有 %d 个租约", n)
+	}
+}
+
+// 同一个ip换成新租约，旧租约的定时器停掉，旧 ID 查不到
+func TestTrackLeaseReplace(t *testing.T) {
+	resetAlloc(t)
+	old := leaseOne(t, "10.4.4.1:80", time.Second)
+	now := time.Now()
+	replaced := &pool.Lease{ID: newLeaseID(), IP: old.IP, Holder: "new", LeasedAt: now.Unix(), ExpireAt: now.Add(time.Minute).Unix()}
+	trackLease(replaced)
+
+	if _, ok := GetLease(old.ID); ok {
+		t.Fatal("替换后旧 ID 还能查到")
+	}
+	if _, ok := leaseIDs.Load(old.ID); ok {
+		t.Fatal("替换后旧 ID 还在索引里")
+	}
+	if n := usedCount.Load(); n != 1 {
+		t.Fatalf("替换后租约数 = %d", n)
+	}
+	// 旧租约 1 秒到期，定时器没停会把ip归还
+	time.Sleep(1500 * time.Millisecond)
+	if got, ok := GetLease(replaced.ID); !ok || got.Holder != "new" {
+		t.Fatalf("新租约被旧的定时器归还了: %v %v", got, ok)
+	}
+	if s := stateOf(t, old.IP); s != pool.StateLeased {
+		t.Fatalf("替换后状态 = %s", s)
+	}
+}
@@ -0,0 +1,105 @@
+package target
+
+import (
+	"FreeProxyMange/conf"
+	"FreeProxyMange/pool"
+	"os"
+	"testing"
+)
+
+// 池子、租约都按相对路径打开，整个包的测试在同一个临时目录里跑
+func TestMain(m *testing.M) {
+	wd, _ := os.Getwd()
+	dir, err := os.MkdirTemp("", "target-test")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	conf.Init()
+	code := m.Run()
+	pool.CloseDB()
+	_ = os.Chdir(wd)
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// 写配置文件并加载，测试结束恢复成空配置
+func useConf(t *testing.T, yaml string) {
+	t.Helper()
+	if err := os.WriteFile(conf.Path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf.Init()
+	t.Cleanup(func() {
+		_ = os.WriteFile(conf.Path, nil, 0644)
+		conf.Init()
+	})
+}
+
+// 放进池子并标记为可用，不放入未使用
+// 和检查通过一样从检查中改成可用，按状态查找时能找到
+func putAvailable(t testing.TB, ip *pool.ProxyIP) {
+	t.Helper()
+	ip.State = pool.StateValidating
+	if err := pool.BadgerUpsertStruct(pool.DBPath(ip.IP), ip.IP, ip); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.SetState(ip.IP, pool.StateAvailable, "测试"); err != nil {
+		t.Fatal(err)
+	}
+	ip.State = pool.StateAvailable
+}
+
+// 测试结束清掉未使用和租约
+func resetAlloc(t testing.TB) {
+	t.Helper()
+	t.Cleanup(func() {
+		Used.Range(func(k, v any) bool {
+			endLease(k.(string), v.(*leaseEntry).lease.ID)
+			return true
+		})
+		NotUsed = newAvailablePool()
+	})
+}
+
+// 模拟重启: 停掉定时器、关库，清空内存里的分配情况，重新打开库后按库里的数据恢复
+func restart(t *testing.T) {
+	t.Helper()
+	stopLeases()
+	stopSessions()
+	pool.CloseDB()
+
+	Used.Range(func(k, _ any) bool {
+		Used.Delete(k)
+		return true
+	})
+	leaseIDs.Range(func(k, _ any) bool {
+		leaseIDs.Delete(k)
+		return true
+	})
+	usedCount.Store(0)
+	leasedCountLock.Lock()
+	leasedExits = make(map[string]int)
+	leasedSubnets = make(map[string]int)
+	leasedCountLock.Unlock()
+	sessionsLock.Lock()
+	sessions = make(map[string]*sessionEntry)
+	sessionsLock.Unlock()
+	NotUsed = newAvailablePool()
+
+	pool.ReopenDB()
+	restore()
+	restoreSessions()
+}
+
+// 测试结束删除所有会话
+func resetSessions(t *testing.T) {
+	t.Helper()
+	t.Cleanup(func() {
+		for _, s := range ListSessions() {
+			_ = DeleteSession(s.Key)
+		}
+	})
+}
@@ -0,0 +1,198 @@
+package target
+
+import (
+	"FreeProxyMange/conf"
+	"FreeProxyMange/pool"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	gt "github.com/mangenotwork/gathertool"
+)
+
+/*
+
+粘性会话:
+/get?session=名称 同一个会话一直用同一个ip，适合登录、多步操作
+1. 会话绑定的ip还是已分配状态并且租约有效就返回它，同时续租
+2. ip被检查判定不可用、租约到期或被归还、在请求的域名上被禁用时换绑一个新的，返回里标记 rebind
+3. 空闲超过 sessionTTL(默认 10m) 会话删除并归还租约，租约时长和空闲时长一致，每次使用都续租
+4. 会话存在 pool 的 ./session，重启后恢复
+
+*/
+
+var ErrSessionNotFound = errors.New("会话不存在或已过期")
+
+type sessionEntry struct {
+	session *pool.Session
+	timer   *time.Timer
+}
+
+var (
+	sessions     = make(map[string]*sessionEntry)
+	sessionsLock sync.Mutex
+)
+
+// SessionTTL 会话空闲多久后删除
+func SessionTTL() time.Duration {
+	return conf.Duration("sessionTTL", 10*time.Minute)
+}
+
+// StickyIP 返回会话绑定的ip，没有绑定或者绑定的不能用了按筛选条件和策略分配一个新的
+// 返回的 bool 表示这次是换绑，没有可用的ip返回 nil
+func StickyIP(key string, filter *Filter, strategy Strategy, holder string) (*pool.ProxyIP, *pool.Lease, *pool.Session, bool) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	ttl := SessionTTL()
+	entry, exists := sessions[key]
+	if exists {
+		if ip, lease, ok := stickyAlive(entry.session, filter, ttl); ok {
+			recordDomainUse(ip, filter.Domain)
+			touchSession(entry, ttl)
+			return ip, lease, copySession(entry.session), false
+		}
+		// 不能用的租约还在就先归还，换绑时不再选它
+		if endLease(entry.session.IP, entry.session.LeaseID) {
+			release(entry.session.IP, OutcomeSuccess, "会话换绑归还")
+		}
+		f := *filter
+		f.Exclude = append(append([]string{}, filter.Exclude...), entry.session.IP)
+		filter = &f
+	}
+
+	// 和不等待的 /get 一样，有请求在排队时不能插队
+	ip, lease := WaitIP(context.Background(), filter, strategy, holder, ttl, 0)
+	if ip == nil {
+		return nil, nil, nil, false
+	}
+	if !exists {
+		entry = &sessionEntry{session: &pool.Session{Key: key, CreatedAt: time.Now().Unix()}}
+		entry.timer = time.AfterFunc(ttl, func() { expireSession(key, entry) })
+		sessions[key] = entry
+	} else {
+		entry.session.Rebinds++
+		gt.Info("会话 ", key, " 换绑 ", entry.session.IP, " -> ", ip.IP)
+	}
+	entry.session.IP = ip.IP
+	entry.session.LeaseID = lease.ID
+	entry.session.Holder = holder
+	touchSession(entry, ttl)
+	return ip, lease, copySession(entry.session), exists
+}
+
+// 会话绑定的ip是否还能用，能用的续租
+func stickyAlive(s *pool.Session, filter *Filter, ttl time.Duration) (*pool.ProxyIP, *pool.Lease, bool) {
+	if lease, ok := GetLease(s.LeaseID); !ok || lease.IP != s.IP {
+		return nil, nil, false
+	}
+	ip, ok, err := pool.Get(s.IP)
+	if err != nil || !ok || ip.State != pool.StateLeased || ip.DomainBanned(filter.Domain) {
+		return nil, nil, false
+	}
+	lease, err := Renew(s.LeaseID, ttl)
+	if err != nil {
+		return nil, nil, false
+	}
+	return ip, lease, true
+}
+
+// 更新最后使用时间并重新计算空闲到期，调用方持有 sessionsLock
+func touchSession(entry *sessionEntry, ttl time.Duration) {
+	now := time.Now()
+	entry.session.LastUsed = now.Unix()
+	entry.session.ExpireAt = now.Add(ttl).Unix()
+	entry.timer.Reset(ttl)
+	if err := pool.SaveSession(entry.session); err != nil {
+		gt.Error(err)
+	}
+}
+
+// 空闲到期，定时器触发时会话已经被删除或换成新的就不处理
+func expireSession(key string, entry *sessionEntry) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if sessions[key] != entry || time.Now().Unix() < entry.session.ExpireAt {
+		return
+	}
+	removeSession(key, entry, "会话空闲到期归还")
+}
+
+// 删除会话并归还租约，调用方持有 sessionsLock
+func removeSession(key string, entry *sessionEntry, reason string) {
+	entry.timer.Stop()
+	delete(sessions, key)
+	if err := pool.DeleteSession(key); err != nil {
+		gt.Error(err)
+	}
+	if endLease(entry.session.IP, entry.session.LeaseID) {
+		release(entry.session.IP, OutcomeSuccess, reason)
+	}
+}
+
+// DeleteSession 删除会话并归还绑定的ip
+func DeleteSession(key string) error {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	entry, ok := sessions[key]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	removeSession(key, entry, "会话删除归还")
+	return nil
+}
+
+// ListSessions 所有会话，按 key 排序
+func ListSessions() []*pool.Session {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	list := make([]*pool.Session, 0, len(sessions))
+	for _, entry := range sessions {
+		list = append(list, copySession(entry.session))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+func copySession(s *pool.Session) *pool.Session {
+	v := *s
+	return &v
+}
+
+// restoreSessions 重启后恢复没有过期的会话，绑定的租约已经没了的下次使用时换绑
+func restoreSessions() {
+	list, err := pool.AllSessions()
+	if err != nil {
+		gt.Error(err)
+		return
+	}
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	now := time.Now()
+	restored := 0
+	for _, s := range list {
+		if s.ExpireAt <= now.Unix() {
+			if err := pool.DeleteSession(s.Key); err != nil {
+				gt.Error(err)
+			}
+			continue
+		}
+		key := s.Key
+		entry := &sessionEntry{session: s}
+		entry.timer = time.AfterFunc(time.Until(time.Unix(s.ExpireAt, 0)), func() { expireSession(key, entry) })
+		sessions[key] = entry
+		restored++
+	}
+	gt.Info("恢复会话 ", restored, " 个，清理过期会话 ", len(list)-restored, " 个")
+}
+
+// stopSessions 程序退出时停掉所有定时器，会话保留在库里
+func stopSessions() {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	for _, entry := range sessions {
+		entry.timer.Stop()
+	}
+}
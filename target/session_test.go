@@ -0,0 +1,140 @@
+package target
+
+import (
+	"FreeProxyMange/pool"
+	"testing"
+	"time"
+)
+
+// 会话绑定的ip被检查判定死亡，下次使用换绑新的
+func TestStickyRebindOnDead(t *testing.T) {
+	resetAlloc(t)
+	resetSessions(t)
+	putBatch(t, &pool.ProxyIP{IP: "10.8.1.1:80", Score: 90}, &pool.ProxyIP{IP: "10.8.1.2:80", Score: 80})
+
+	ip, lease, s, rebind := StickyIP("login", &Filter{}, score{}, "t")
+	if ip == nil || ip.IP != "10.8.1.1:80" || rebind || s.LeaseID != lease.ID {
+		t.Fatalf("第一次分到 %v rebind=%v %+v", ip, rebind, s)
+	}
+	again, _, _, rebind := StickyIP("login", &Filter{}, score{}, "t")
+	if again == nil || again.IP != ip.IP || rebind {
+		t.Fatalf("再次使用分到 %v rebind=%v", again, rebind)
+	}
+
+	// 和检查调度器一样改状态后回调
+	dead, err := pool.SetState(ip.IP, pool.StateDead, "测试死亡")
+	if err != nil {
+		t.Fatal(err)
+	}
+	onChecked(dead, nil)
+
+	next, nextLease, s, rebind := StickyIP("login", &Filter{}, score{}, "t")
+	if next == nil || next.IP != "10.8.1.2:80" || !rebind {
+		t.Fatalf("死亡后分到 %v rebind=%v", next, rebind)
+	}
+	if s.IP != next.IP || s.LeaseID != nextLease.ID || s.Rebinds != 1 {
+		t.Fatalf("换绑后会话 %+v", s)
+	}
+	if _, ok := GetLease(lease.ID); ok {
+		t.Fatal("死亡的ip租约还在")
+	}
+}
+
+// 空闲超过 sessionTTL 删除会话并归还ip
+func TestStickyIdleExpire(t *testing.T) {
+	useConf(t, "sessionTTL: 1s\n")
+	resetAlloc(t)
+	resetSessions(t)
+	putBatch(t, &pool.ProxyIP{IP: "10.8.2.1:80", Score: 90})
+
+	ip, _, _, _ := StickyIP("idle", &Filter{}, score{}, "t")
+	if ip == nil {
+		t.Fatal("没有分到ip")
+	}
+	waitUntil(t, 3*time.Second, func() bool {
+		return len(ListSessions()) == 0
+	})
+	if err := DeleteSession("idle"); err != ErrSessionNotFound {
+		t.Fatalf("过期后删除: %v", err)
+	}
+	saved, err := pool.AllSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range saved {
+		if s.Key == "idle" {
+			t.Fatalf("库里还有过期的会话 %+v", s)
+		}
+	}
+	waitUntil(t, time.Second, func() bool {
+		_, ok := NotUsed.Load(ip.IP)
+		return ok
+	})
+	if s := stateOf(t, ip.IP); s != pool.StateAvailable {
+		t.Fatalf("过期归还后状态 = %s", s)
+	}
+}
+
+// 重启后会话、租约和未使用按库里的恢复
+func TestRestoreAfterRestart(t *testing.T) {
+	resetAlloc(t)
+	resetSessions(t)
+	sticky := &pool.ProxyIP{IP: "10.8.3.1:80", Score: 90}
+	plain := &pool.ProxyIP{IP: "10.8.3.2:80", Score: 80}
+	idle := &pool.ProxyIP{IP: "10.8.3.3:80", Score: 70}
+	expired := &pool.ProxyIP{IP: "10.8.3.4:80", Score: 60}
+	putBatch(t, sticky, plain, idle, expired)
+
+	_, stickyLease, _, _ := StickyIP("restart", &Filter{}, score{}, "t")
+	_, plainLease := UseIP(&Filter{}, score{}, "t", time.Minute)
+	_, expiredLease := UseIP(&Filter{Exclude: []string{idle.IP}}, score{}, "t", time.Minute)
+	if stickyLease == nil || plainLease == nil || expiredLease == nil {
+		t.Fatal("没有分到ip")
+	}
+	if stickyLease.IP != sticky.IP || plainLease.IP != plain.IP || expiredLease.IP != expired.IP {
+		t.Fatalf("分到 %s %s %s", stickyLease.IP, plainLease.IP, expiredLease.IP)
+	}
+	// 停机期间到期的租约
+	old := *expiredLease
+	old.ExpireAt = time.Now().Add(-time.Minute).Unix()
+	if err := pool.SaveLease(&old); err != nil {
+		t.Fatal(err)
+	}
+
+	restart(t)
+
+	for _, l := range []*pool.Lease{stickyLease, plainLease} {
+		got, ok := GetLease(l.ID)
+		if !ok || got.IP != l.IP || got.ExpireAt != l.ExpireAt {
+			t.Fatalf("重启后租约 %s: %v %v", l.IP, got, ok)
+		}
+		if s := stateOf(t, l.IP); s != pool.StateLeased {
+			t.Fatalf("重启后 %s 状态 = %s", l.IP, s)
+		}
+	}
+	if _, ok := GetLease(expiredLease.ID); ok {
+		t.Fatal("停机期间到期的租约恢复了")
+	}
+	for _, ip := range []string{idle.IP, expired.IP} {
+		if _, ok := NotUsed.Load(ip); !ok {
+			t.Fatalf("重启后 %s 不在未使用里", ip)
+		}
+		if s := stateOf(t, ip); s != pool.StateAvailable {
+			t.Fatalf("重启后 %s 状态 = %s", ip, s)
+		}
+	}
+	for _, ip := range []string{sticky.IP, plain.IP} {
+		if _, ok := NotUsed.Load(ip); ok {
+			t.Fatalf("已分配的 %s 放进了未使用", ip)
+		}
+	}
+	if n := usedCount.Load(); n != 2 {
+		t.Fatalf("重启后租约数 = %d", n)
+	}
+
+	// 恢复的会话继续用原来的ip
+	ip, lease, s, rebind := StickyIP("restart", &Filter{}, score{}, "t")
+	if ip == nil || ip.IP != sticky.IP || rebind || lease.ID != stickyLease.ID || s.Rebinds != 0 {
+		t.Fatalf("重启后会话分到 %v rebind=%v %+v", ip, rebind, s)
+	}
+}
@@ -0,0 +1,236 @@
+package target
+
+import (
+	"FreeProxyMange/conf"
+	"FreeProxyMange/pool"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+
+分配策略:
+从符合筛选条件的未使用ip里选一个，/get?strategy=名称 按请求指定，
+也可以在配置文件 clientStrategy 里按使用方(holder)指定，都没有用 strategy 配置的，默认 score
+除 score 外的策略在所有符合条件的ip里挑，批量分配的 score 在分数最高的 candidateLimit 个候选里挑，见 Candidates
+
+round-robin   按ip顺序轮流分配
+lru           最久没有分配过的优先
+latency       最后一次检查响应时间最短的优先
+score         质量分最高的优先
+weighted      按质量分加权随机
+least-leased  所在网段当前租约最少的优先，相同时累计分配次数少的优先
+
+新增策略实现 Strategy 接口后用 RegisterStrategy 注册
+
+*/
+
+const DefaultStrategy = "score"
+
+// Strategy 分配策略，candidates 不为空，返回其中一个
+type Strategy interface {
+	Name() string
+	Pick(candidates []*pool.ProxyIP) *pool.ProxyIP
+}
+
+var (
+	strategies     = make(map[string]Strategy)
+	strategiesLock sync.RWMutex
+)
+
+func RegisterStrategy(s Strategy) {
+	strategiesLock.Lock()
+	defer strategiesLock.Unlock()
+	strategies[s.Name()] = s
+}
+
+func GetStrategy(name string) (Strategy, bool) {
+	strategiesLock.RLock()
+	defer strategiesLock.RUnlock()
+	s, ok := strategies[name]
+	return s, ok
+}
+
+// StrategyNames 所有已注册的策略名
+func StrategyNames() []string {
+	strategiesLock.RLock()
+	defer strategiesLock.RUnlock()
+	names := make([]string, 0, len(strategies))
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StrategyFor 请求指定的优先，其次是使用方配置的，最后是默认的
+func StrategyFor(name, holder string) (Strategy, bool) {
+	if name != "" {
+		return GetStrategy(name)
+	}
+	if clients, ok := conf.Get("clientStrategy").(map[string]interface{}); ok {
+		if v, ok := clients[holder].(string); ok {
+			if s, ok := GetStrategy(v); ok {
+				return s, true
+			}
+		}
+	}
+	if s, ok := GetStrategy(conf.Str("strategy", DefaultStrategy)); ok {
+		return s, true
+	}
+	return GetStrategy(DefaultStrategy)
+}
+
+func init() {
+	RegisterStrategy(&roundRobin{})
+	RegisterStrategy(lru{})
+	RegisterStrategy(latency{})
+	RegisterStrategy(score{})
+	RegisterStrategy(weighted{})
+	RegisterStrategy(leastLeased{})
+}
+
+// ================ 分配统计 ================
+
+type useStat struct {
+	last  atomic.Int64 // 最后分配时间 UnixNano
+	count atomic.Int64 // 累计分配次数
+}
+
+var useStats sync.Map // ip -> *useStat
+
+func recordUse(ip string) {
+	v, _ := useStats.LoadOrStore(ip, &useStat{})
+	stat := v.(*useStat)
+	stat.last.Store(time.Now().UnixNano())
+	stat.count.Add(1)
+}
+
+func getUseStat(ip string) (last int64, count int64) {
+	if v, ok := useStats.Load(ip); ok {
+		stat := v.(*useStat)
+		return stat.last.Load(), stat.count.Load()
+	}
+	return 0, 0
+}
+
+// ================ 策略实现 ================
+
+type roundRobin struct {
+	lock sync.Mutex
+	last string
+}
+
+func (s *roundRobin) Name() string { return "round-robin" }
+
+func (s *roundRobin) Pick(candidates []*pool.ProxyIP) *pool.ProxyIP {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// 取比上一次大的最小的ip，没有就从头开始
+	var next, first *pool.ProxyIP
+	for _, v := range candidates {
+		if first == nil || v.IP < first.IP {
+			first = v
+		}
+		if v.IP > s.last && (next == nil || v.IP < next.IP) {
+			next = v
+		}
+	}
+	if next == nil {
+		next = first
+	}
+	s.last = next.IP
+	return next
+}
+
+type lru struct{}
+
+func (lru) Name() string { return "lru" }
+
+func (lru) Pick(candidates []*pool.ProxyIP) *pool.ProxyIP {
+	var pick *pool.ProxyIP
+	var pickLast int64
+	for _, v := range candidates {
+		last, _ := getUseStat(v.IP)
+		if pick == nil || last < pickLast || last == pickLast && v.Score > pick.Score {
+			pick, pickLast = v, last
+		}
+	}
+	return pick
+}
+
+type latency struct{}
+
+func (latency) Name() string { return "latency" }
+
+func (latency) Pick(candidates []*pool.ProxyIP) *pool.ProxyIP {
+	var pick *pool.ProxyIP
+	for _, v := range candidates {
+		// 没有响应时间的排最后
+		if pick == nil || pick.Ms <= 0 || v.Ms > 0 && v.Ms < pick.Ms {
+			pick = v
+		}
+	}
+	return pick
+}
+
+type score struct{}
+
+func (score) Name() string { return "score" }
+
+func (score) Pick(candidates []*pool.ProxyIP) *pool.ProxyIP {
+	var pick *pool.ProxyIP
+	for _, v := range candidates {
+		if pick == nil || v.Score > pick.Score {
+			pick = v
+		}
+	}
+	return pick
+}
+
+type weighted struct{}
+
+func (weighted) Name() string { return "weighted" }
+
+func (weighted) Pick(candidates []*pool.ProxyIP) *pool.ProxyIP {
+	// 分数可能是负的，权重至少为 1
+	total := 0.0
+	weights := make([]float64, len(candidates))
+	for i, v := range candidates {
+		w := v.Score
+		if w < 1 {
+			w = 1
+		}
+		weights[i] = w
+		total += w
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		r -= w
+		if r < 0 {
+			return candidates[i]
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+type leastLeased struct{}
+
+func (leastLeased) Name() string { return "least-leased" }
+
+func (leastLeased) Pick(candidates []*pool.ProxyIP) *pool.ProxyIP {
+	var pick *pool.ProxyIP
+	var pickActive int
+	var pickCount int64
+	for _, v := range candidates {
+		n := leasedInSubnet(pool.Subnet(v.IP))
+		_, count := getUseStat(v.IP)
+		if pick == nil || n < pickActive || n == pickActive && count < pickCount {
+			pick, pickActive, pickCount = v, n, count
+		}
+	}
+	return pick
+}
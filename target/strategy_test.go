@@ -0,0 +1,127 @@
+package target
+
+import (
+	"FreeProxyMange/pool"
+	"testing"
+)
+
+func testIPs(ips ...*pool.ProxyIP) []*pool.ProxyIP { return ips }
+
+// 设置分配统计，测试结束删掉
+func setUseStat(t *testing.T, ip string, last, count int64) {
+	t.Helper()
+	stat := &useStat{}
+	stat.last.Store(last)
+	stat.count.Store(count)
+	useStats.Store(ip, stat)
+	t.Cleanup(func() { useStats.Delete(ip) })
+}
+
+// 设置网段的租约数，测试结束减回去
+func setLeased(t *testing.T, ip string, n int) {
+	t.Helper()
+	countLeased("", pool.Subnet(ip), n)
+	t.Cleanup(func() { countLeased("", pool.Subnet(ip), -n) })
+}
+
+func TestPick(t *testing.T) {
+	a := &pool.ProxyIP{IP: "10.0.1.1:80", Score: 50, Ms: 300}
+	b := &pool.ProxyIP{IP: "10.0.2.1:80", Score: 80, Ms: 0}
+	c := &pool.ProxyIP{IP: "10.0.3.1:80", Score: 20, Ms: 100}
+
+	cases := []struct {
+		name       string
+		strategy   Strategy
+		setup      func(t *testing.T)
+		candidates []*pool.ProxyIP
+		want       *pool.ProxyIP
+	}{
+		{"score 取分数最高", score{}, nil, testIPs(a, b, c), b},
+		{"latency 取响应最快", latency{}, nil, testIPs(a, b, c), c},
+		{"latency 没有响应时间的排最后", latency{}, nil, testIPs(b, a), a},
+		{"lru 没分配过的优先", lru{}, func(t *testing.T) {
+			setUseStat(t, a.IP, 100, 1)
+			setUseStat(t, b.IP, 200, 1)
+		}, testIPs(a, b, c), c},
+		{"lru 最久没分配的优先", lru{}, func(t *testing.T) {
+			setUseStat(t, a.IP, 300, 1)
+			setUseStat(t, b.IP, 200, 1)
+			setUseStat(t, c.IP, 400, 1)
+		}, testIPs(a, b, c), b},
+		{"lru 都没分配过按分数", lru{}, nil, testIPs(a, b, c), b},
+		{"least-leased 网段租约少的优先", leastLeased{}, func(t *testing.T) {
+			setLeased(t, a.IP, 2)
+			setLeased(t, b.IP, 1)
+			setLeased(t, c.IP, 3)
+		}, testIPs(a, b, c), b},
+		{"least-leased 租约相同按累计分配次数", leastLeased{}, func(t *testing.T) {
+			setUseStat(t, a.IP, 0, 5)
+			setUseStat(t, b.IP, 0, 3)
+			setUseStat(t, c.IP, 0, 9)
+		}, testIPs(a, b, c), b},
+		{"weighted 只有一个", weighted{}, nil, testIPs(c), c},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.setup != nil {
+				tc.setup(t)
+			}
+			if got := tc.strategy.Pick(tc.candidates); got != tc.want {
+				t.Fatalf("Pick = %s, 期望 %s", got.IP, tc.want.IP)
+			}
+		})
+	}
+}
+
+func TestPickRoundRobin(t *testing.T) {
+	a := &pool.ProxyIP{IP: "10.0.0.1:80"}
+	b := &pool.ProxyIP{IP: "10.0.0.2:80"}
+	c := &pool.ProxyIP{IP: "10.0.0.3:80"}
+	s := &roundRobin{}
+	cases := []struct {
+		candidates []*pool.ProxyIP
+		want       *pool.ProxyIP
+	}{
+		{testIPs(c, a, b), a},
+		{testIPs(c, a, b), b},
+		{testIPs(c, a, b), c},
+		{testIPs(c, a, b), a}, // 到头了从最小的开始
+		{testIPs(a, c), c},    // b 被分配出去了跳过
+		{testIPs(b), b},
+	}
+	for i, tc := range cases {
+		if got := s.Pick(tc.candidates); got != tc.want {
+			t.Fatalf("第 %d 次 Pick = %s, 期望 %s", i+1, got.IP, tc.want.IP)
+		}
+	}
+}
+
+func TestPickWeighted(t *testing.T) {
+	cases := []struct {
+		name   string
+		scores []float64
+		want   []float64 // 期望的分配比例
+	}{
+		{"按分数加权", []float64{100, 300}, []float64{0.25, 0.75}},
+		{"负分和 0 分权重为 1", []float64{-50, 0, 1}, []float64{1.0 / 3, 1.0 / 3, 1.0 / 3}},
+	}
+	const n = 20000
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			candidates := make([]*pool.ProxyIP, len(tc.scores))
+			for i, s := range tc.scores {
+				candidates[i] = &pool.ProxyIP{IP: string(rune('a' + i)), Score: s}
+			}
+			got := make(map[*pool.ProxyIP]int)
+			for i := 0; i < n; i++ {
+				got[weighted{}.Pick(candidates)]++
+			}
+			for i, ip := range candidates {
+				ratio := float64(got[ip]) / n
+				if ratio < tc.want[i]-0.03 || ratio > tc.want[i]+0.03 {
+					t.Fatalf("%s 分配比例 = %.3f, 期望 %.3f", ip.IP, ratio, tc.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package target
+
+import (
+	"FreeProxyMange/conf"
+	"FreeProxyMange/pool"
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+/*
+
+等待分配:
+/get?wait=30s 没有符合条件的ip时挂起等待，直到分到ip或者超时
+1. 等待的请求按先来后到排队，有ip放回未使用时从队头开始逐个尝试分配，条件不满足的不挡后面的
+2. 冷却和复用限制到期不会有通知，有人等待时每秒再尝试一次，未使用为空时不尝试
+3. 有请求分不到ip时触发 pool.Demand，马上检查冷却中的ip并采集
+4. 最长等待 waitMaxTime(默认 60s)，调用方断开或者程序退出时停止等待
+5. 不等待的 /get 有人排队时也要排到队尾，不能插到等待的请求前面，
+   会话换绑和不等待的 /get 一样排队，批量分配先给排队的请求分配完再在同一个分配过程里分配，见 afterWaiters
+6. 分配在 waitersLock 外进行，分到时等待的请求已经走了就归还
+
+*/
+
+type waiter struct {
+	filter   *Filter
+	strategy Strategy
+	holder   string
+	d        time.Duration
+	elem     *list.Element
+	served   bool // 已经分配，在 waitersLock 下读写
+	gone     bool // 已经超时离开队列，在 waitersLock 下读写
+	result   chan Allocation
+}
+
+var (
+	waiters     = list.New()
+	waitersLock sync.Mutex
+	waitSignal  = make(chan struct{}, 1)
+	waitStop    = make(chan struct{})
+
+	// 同时只有一个分配过程，保证按排队顺序分配
+	dispatchLock sync.Mutex
+)
+
+// WaitDuration 按配置修正请求的等待时长，超过上限按上限
+func WaitDuration(d time.Duration) time.Duration {
+	if max := conf.Duration("waitMaxTime", time.Minute); d > max {
+		d = max
+	}
+	return d
+}
+
+// WaitIP 和 UseIP 一样分配一个ip，没有时排队等待，超时返回 nil
+// wait 为 0 不等待，但有人在排队时也要排在后面，不能插队
+func WaitIP(ctx context.Context, filter *Filter, strategy Strategy, holder string, d, wait time.Duration) (*pool.ProxyIP, *pool.Lease) {
+	w := &waiter{filter: filter, strategy: strategy, holder: holder, d: d, result: make(chan Allocation, 1)}
+	waitersLock.Lock()
+	if wait <= 0 && waiters.Len() == 0 {
+		waitersLock.Unlock()
+		return UseIP(filter, strategy, holder, d)
+	}
+	w.elem = waiters.PushBack(w)
+	waitersLock.Unlock()
+
+	// 前面没有人在等或者前面的条件都不满足就能马上分到
+	dispatchWaiters()
+	if wait <= 0 {
+		return leaveWaiters(ctx, w)
+	}
+	timer := time.NewTimer(WaitDuration(wait))
+	defer timer.Stop()
+	select {
+	case a := <-w.result:
+		return a.IP, a.Lease
+	case <-timer.C:
+	case <-ctx.Done():
+	case <-waitStop:
+	}
+	return leaveWaiters(ctx, w)
+}
+
+// 不再等待，离开队列，刚好分到了的照常返回
+func leaveWaiters(ctx context.Context, w *waiter) (*pool.ProxyIP, *pool.Lease) {
+	waitersLock.Lock()
+	if !w.served {
+		w.gone = true
+		waiters.Remove(w.elem)
+		waitersLock.Unlock()
+		return nil, nil
+	}
+	waitersLock.Unlock()
+	a := <-w.result
+	// 超时的同时分到了，调用方已经断开的退回去
+	if ctx.Err() != nil {
+		giveBack(a)
+		return nil, nil
+	}
+	return a.IP, a.Lease
+}
+
+func giveBack(a Allocation) {
+	if endLease(a.IP.IP, a.Lease.ID) {
+		release(a.IP.IP, OutcomeSuccess, "等待的请求已离开")
+	}
+}
+
+// 从队头开始给等待的请求分配，还有人没分到就按需补充
+// 分配不在 waitersLock 下做，排队和离开不会被分配卡住
+func dispatchWaiters() {
+	dispatchLock.Lock()
+	defer dispatchLock.Unlock()
+	serveWaiters()
+}
+
+// afterWaiters 先给排队的请求分配，再在同一个分配过程里执行 fn，
+// 批量分配不能排进队列，用这个保证不会插到等待的请求前面
+func afterWaiters(fn func()) {
+	dispatchLock.Lock()
+	defer dispatchLock.Unlock()
+	serveWaiters()
+	fn()
+}
+
+// 调用方持有 dispatchLock
+func serveWaiters() {
+	waitersLock.Lock()
+	list := make([]*waiter, 0, waiters.Len())
+	for e := waiters.Front(); e != nil; e = e.Next() {
+		list = append(list, e.Value.(*waiter))
+	}
+	waitersLock.Unlock()
+
+	for _, w := range list {
+		// 没有未使用的ip了，后面的都分不到
+		if NotUsed.Len() == 0 {
+			break
+		}
+		waitersLock.Lock()
+		gone := w.gone
+		waitersLock.Unlock()
+		if gone {
+			continue
+		}
+		ip, lease := UseIP(w.filter, w.strategy, w.holder, w.d)
+		if ip == nil {
+			continue
+		}
+		a := Allocation{IP: ip, Lease: lease}
+		waitersLock.Lock()
+		if w.gone {
+			waitersLock.Unlock()
+			giveBack(a)
+			continue
+		}
+		w.served = true
+		waiters.Remove(w.elem)
+		waitersLock.Unlock()
+		w.result <- a
+	}
+
+	waitersLock.Lock()
+	n := waiters.Len()
+	waitersLock.Unlock()
+	if n > 0 {
+		pool.Demand()
+	}
+}
+
+// 有ip放回未使用，通知等待的请求
+func signalWaiters() {
+	select {
+	case waitSignal <- struct{}{}:
+	default:
+	}
+}
+
+// putNotUsed 放入未使用并通知等待的请求
+func putNotUsed(ip *pool.ProxyIP) {
+	NotUsed.Store(ip)
+	signalWaiters()
+}
+
+// runWaiters 有ip放回或者每秒给等待的请求分配一次，退出时让所有等待的请求返回
+func runWaiters(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			close(waitStop)
+			return
+		case <-waitSignal:
+		case <-ticker.C:
+		}
+		dispatchWaiters()
+	}
+}
@@ -0,0 +1,164 @@
+package target
+
+import (
+	"FreeProxyMange/pool"
+	"context"
+	"testing"
+	"time"
+)
+
+// 等到有 n 个请求在排队
+func waitQueued(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		waitersLock.Lock()
+		got := waiters.Len()
+		waitersLock.Unlock()
+		if got == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("排队的请求没有到 %d 个", n)
+}
+
+type waitResult struct {
+	name string
+	ip   *pool.ProxyIP
+}
+
+func TestWaitFIFO(t *testing.T) {
+	resetAlloc(t)
+	results := make(chan waitResult, 2)
+	for i, name := range []string{"first", "second"} {
+		go func(name string) {
+			ip, _ := WaitIP(context.Background(), &Filter{}, score{}, name, 0, 2*time.Second)
+			results <- waitResult{name, ip}
+		}(name)
+		waitQueued(t, i+1)
+	}
+
+	ip := &pool.ProxyIP{IP: "10.2.0.1:80"}
+	putAvailable(t, ip)
+	putNotUsed(ip)
+	dispatchWaiters()
+	r := <-results
+	if r.name != "first" || r.ip == nil || r.ip.IP != ip.IP {
+		t.Fatalf("先排队的应该先分到: %+v", r)
+	}
+	r = <-results
+	if r.name != "second" || r.ip != nil {
+		t.Fatalf("后排队的应该超时: %+v", r)
+	}
+}
+
+// 不等待的请求有人在排队时不能插队
+func TestPlainGetDoesNotJumpQueue(t *testing.T) {
+	resetAlloc(t)
+	results := make(chan waitResult, 1)
+	go func() {
+		ip, _ := WaitIP(context.Background(), &Filter{}, score{}, "waiting", 0, 2*time.Second)
+		results <- waitResult{"waiting", ip}
+	}()
+	waitQueued(t, 1)
+
+	// 放入但不通知，模拟有ip的同时来了一个不等待的请求
+	ip := &pool.ProxyIP{IP: "10.2.0.2:80"}
+	putAvailable(t, ip)
+	NotUsed.Store(ip)
+	if got, _ := WaitIP(context.Background(), &Filter{}, score{}, "plain", 0, 0); got != nil {
+		t.Fatalf("不等待的请求插队分到了 %s", got.IP)
+	}
+	if r := <-results; r.ip == nil || r.ip.IP != ip.IP {
+		t.Fatalf("排队的请求没有分到: %+v", r)
+	}
+	waitQueued(t, 0)
+}
+
+// 前面的条件不满足不挡后面的，没人排队时不等待的直接分配
+func TestWaitSkipsUnmatched(t *testing.T) {
+	resetAlloc(t)
+	results := make(chan waitResult, 1)
+	go func() {
+		ip, _ := WaitIP(context.Background(), &Filter{Type: pool.ProtocolSocks5}, score{}, "socks", 0, 300*time.Millisecond)
+		results <- waitResult{"socks", ip}
+	}()
+	waitQueued(t, 1)
+
+	ip := &pool.ProxyIP{IP: "10.2.0.3:80", Type: pool.ProtocolHttp, Protocols: []string{pool.ProtocolHttp}}
+	putAvailable(t, ip)
+	NotUsed.Store(ip)
+	got, lease := WaitIP(context.Background(), &Filter{Type: pool.ProtocolHttp}, score{}, "http", 0, 0)
+	if got == nil || lease == nil || got.IP != ip.IP {
+		t.Fatal("条件不同的排队请求挡住了后面的")
+	}
+	if r := <-results; r.ip != nil {
+		t.Fatalf("socks 请求不应该分到: %+v", r)
+	}
+	waitQueued(t, 0)
+
+	ip2 := &pool.ProxyIP{IP: "10.2.0.4:80"}
+	putAvailable(t, ip2)
+	NotUsed.Store(ip2)
+	if got, _ := WaitIP(context.Background(), &Filter{}, score{}, "plain", 0, 0); got == nil || got.IP != ip2.IP {
+		t.Fatal("没人排队时应该直接分配")
+	}
+}
+
+// 会话换绑和批量分配有人在排队时也不能插队
+func TestStickyAndBatchDoNotJumpQueue(t *testing.T) {
+	resetAlloc(t)
+	resetSessions(t)
+	results := make(chan waitResult, 2)
+	for i, name := range []string{"first", "second"} {
+		go func(name string) {
+			ip, _ := WaitIP(context.Background(), &Filter{}, score{}, name, 0, 2*time.Second)
+			results <- waitResult{name, ip}
+		}(name)
+		waitQueued(t, i+1)
+	}
+
+	// 放入但不通知，模拟有ip的同时来了会话和批量请求
+	a := &pool.ProxyIP{IP: "10.2.1.1:80", Score: 90}
+	b := &pool.ProxyIP{IP: "10.2.1.2:80", Score: 80}
+	c := &pool.ProxyIP{IP: "10.2.1.3:80", Score: 70}
+	for _, ip := range []*pool.ProxyIP{a, b} {
+		putAvailable(t, ip)
+		NotUsed.Store(ip)
+	}
+	if ip, _, _, _ := StickyIP("queue", &Filter{}, score{}, "sticky"); ip != nil {
+		t.Fatalf("会话插队分到了 %s", ip.IP)
+	}
+	// 分数高的给先排队的，两个请求返回的先后不一定
+	want := map[string]string{"first": a.IP, "second": b.IP}
+	for range want {
+		if r := <-results; r.ip == nil || r.ip.IP != want[r.name] {
+			t.Fatalf("排队的请求应该按顺序分到: %+v", r)
+		}
+	}
+	waitQueued(t, 0)
+
+	go func() {
+		ip, _ := WaitIP(context.Background(), &Filter{}, score{}, "third", 0, 2*time.Second)
+		results <- waitResult{"third", ip}
+	}()
+	waitQueued(t, 1)
+	putAvailable(t, c)
+	NotUsed.Store(c)
+	if list := UseIPs(&Filter{}, score{}, "batch", 0, 1, Distinct{}, false); len(list) != 0 {
+		t.Fatalf("批量分配插队分到了 %s", list[0].IP.IP)
+	}
+	if r := <-results; r.ip == nil || r.ip.IP != c.IP {
+		t.Fatalf("排队的请求没有分到: %+v", r)
+	}
+	waitQueued(t, 0)
+
+	// 没人排队时照常分配
+	d := &pool.ProxyIP{IP: "10.2.1.4:80"}
+	putAvailable(t, d)
+	NotUsed.Store(d)
+	if ip, _, _, _ := StickyIP("queue", &Filter{}, score{}, "sticky"); ip == nil || ip.IP != d.IP {
+		t.Fatalf("没人排队时会话分到 %v", ip)
+	}
+}